@@ -0,0 +1,387 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+type Key struct {
+	Name       string             `json:"name"`
+	PublicKey  ed25519.PublicKey  `json:"public_key"`
+	PrivateKey ed25519.PrivateKey `json:"private_key"`
+}
+
+// RunRequest is everything a protected run is allowed to do. It is signed by
+// the requester and then by an approver, and executed verbatim.
+type RunRequest struct {
+	Command   string    `json:"command"`
+	Selector  Selector  `json:"selector"`
+	User      string    `json:"user"`
+	Hosts     []string  `json:"hosts"`
+	Requester string    `json:"requester"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+}
+
+type Signature struct {
+	Signer    string            `json:"signer"`
+	PublicKey ed25519.PublicKey `json:"public_key"`
+	Signature []byte            `json:"signature"`
+}
+
+type RunRequestFile struct {
+	Request   RunRequest `json:"request"`
+	Requested Signature  `json:"requested"`
+	Approved  *Signature `json:"approved,omitempty"`
+}
+
+func loadKey(file string) (Key, error) {
+	var key Key
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return key, fmt.Errorf("%v (create one with 'dcr key generate')", err)
+	}
+	if err := json.Unmarshal(raw, &key); err != nil {
+		return key, fmt.Errorf("%s: %v", file, err)
+	}
+	if len(key.PrivateKey) != ed25519.PrivateKeySize {
+		return key, fmt.Errorf("%s: invalid private key", file)
+	}
+	return key, nil
+}
+
+// loadTrustedKeys reads a JSON object mapping approver names to their base64
+// encoded public keys.
+func loadTrustedKeys(file string) (map[string]ed25519.PublicKey, error) {
+	var encoded map[string]string
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &encoded); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	trusted := map[string]ed25519.PublicKey{}
+	for name, value := range encoded {
+		publicKey, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(publicKey) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%s: invalid key for %s", file, name)
+		}
+		trusted[name] = publicKey
+	}
+	return trusted, nil
+}
+
+func (r RunRequest) payload() []byte {
+	payload, _ := json.Marshal(r)
+	return payload
+}
+
+func (r RunRequest) sign(key Key) Signature {
+	return Signature{
+		Signer:    key.Name,
+		PublicKey: key.PublicKey,
+		Signature: ed25519.Sign(key.PrivateKey, r.payload()),
+	}
+}
+
+func (r RunRequest) verify(signature Signature) error {
+	if len(signature.PublicKey) != ed25519.PublicKeySize || !ed25519.Verify(signature.PublicKey, r.payload(), signature.Signature) {
+		return fmt.Errorf("invalid signature by %s", signature.Signer)
+	}
+	return nil
+}
+
+func serverNames(servers Servers) []string {
+	names := []string{}
+	for _, server := range servers {
+		names = append(names, server.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func readRunRequest(file string) (RunRequestFile, error) {
+	var request RunRequestFile
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return request, err
+	}
+	if err := json.Unmarshal(raw, &request); err != nil {
+		return request, fmt.Errorf("%s: %v", file, err)
+	}
+	if err := request.Request.verify(request.Requested); err != nil {
+		return request, err
+	}
+	if time.Now().After(request.Request.Expires) {
+		return request, fmt.Errorf("request expired at %s", request.Request.Expires.Format(time.RFC3339))
+	}
+	return request, nil
+}
+
+func writeRunRequest(file string, request RunRequestFile) error {
+	raw, err := json.MarshalIndent(request, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, raw, 0644)
+}
+
+func requestOrExec(c *cli.Context, run Run, selector Selector) error {
+	if !c.Bool("request-approval") {
+		return runExec(c, run)
+	}
+	file, err := createRunRequest(c.String("key"), c.String("request-file"), run, selector, c.Duration("request-ttl"))
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	fmt.Printf("Wrote run request %s, approve it with 'dcr approve %s'\n", file, file)
+	return nil
+}
+
+func createRunRequest(keyFile string, file string, run Run, selector Selector, ttl time.Duration) (string, error) {
+	key, err := loadKey(keyFile)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	request := RunRequest{
+		Command:   run.Command,
+		Selector:  selector,
+		User:      run.User,
+		Hosts:     serverNames(run.Servers),
+		Requester: key.Name,
+		Created:   now,
+		Expires:   now.Add(ttl),
+	}
+	if file == "" {
+		file = fmt.Sprintf("%s-%s.request.json", run.Environment, now.Format("20060102-150405"))
+	}
+	return file, writeRunRequest(file, RunRequestFile{Request: request, Requested: request.sign(key)})
+}
+
+// approvedRun checks an approved request against the trusted keys and the
+// current inventory, and returns the run it allows.
+func approvedRun(file string, trustedFile string, servers Servers) (Run, error) {
+	request, err := readRunRequest(file)
+	if err != nil {
+		return Run{}, err
+	}
+	if request.Approved == nil {
+		return Run{}, errors.New("request has not been approved")
+	}
+	if err := request.Request.verify(*request.Approved); err != nil {
+		return Run{}, err
+	}
+	trusted, err := loadTrustedKeys(trustedFile)
+	if err != nil {
+		return Run{}, err
+	}
+	// both signatures must come from trusted keys, or anyone could request
+	// with a throwaway key and approve their own run
+	if request.Requested.Signer != request.Request.Requester || !trusted[request.Requested.Signer].Equal(request.Requested.PublicKey) {
+		return Run{}, fmt.Errorf("requester %s is not trusted", request.Requested.Signer)
+	}
+	if !trusted[request.Approved.Signer].Equal(request.Approved.PublicKey) {
+		return Run{}, fmt.Errorf("approver %s is not trusted", request.Approved.Signer)
+	}
+	if request.Approved.Signer == request.Requested.Signer || request.Approved.PublicKey.Equal(request.Requested.PublicKey) {
+		return Run{}, errors.New("request was approved by its requester")
+	}
+
+	run := newRun(servers, request.Request.Selector, request.Request.Command, request.Request.User)
+	approval := sha256.Sum256(request.Requested.Signature)
+	run.Approval = hex.EncodeToString(approval[:])
+	if names := serverNames(run.Servers); !reflect.DeepEqual(names, request.Request.Hosts) {
+		return Run{}, fmt.Errorf("inventory now resolves to %s, approved hosts were %s",
+			strings.Join(names, ","), strings.Join(request.Request.Hosts, ","))
+	}
+	return run, nil
+}
+
+// useRunRequest records that an approved run request was run, so that one
+// approval allows one run. The records are kept next to the run locks, which
+// may be shared between machines.
+func useRunRequest(lockDir string, approval string) error {
+	dir := filepath.Join(lockDir, "used-requests")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, approval), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if os.IsExist(err) {
+		return errors.New("the run request has already been used")
+	}
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%s %s\n", time.Now().Format(time.RFC3339), currentOwner())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func requestFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.BoolFlag{
+			Name:  "request-approval",
+			Usage: "Write a signed run request instead of executing",
+		},
+		cli.StringFlag{
+			Name:  "request-file",
+			Usage: "Write the run request to `FILE`",
+		},
+		cli.DurationFlag{
+			Name:  "request-ttl",
+			Value: 24 * time.Hour,
+			Usage: "Let the run request expire after `DURATION`",
+		},
+		cli.StringFlag{
+			Name:  "key",
+			Value: dcrPath("key.json"),
+			Usage: "Sign with the key in `FILE`",
+		},
+	}
+}
+
+func approvedFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "approved",
+			Usage: "Execute the approved run request in `FILE`",
+		},
+		cli.StringFlag{
+			Name:  "trusted-keys",
+			Value: dcrPath("trusted_keys.json"),
+			Usage: "Accept approvals by the keys in `FILE`",
+		},
+	}
+}
+
+func printRunRequest(request RunRequest) {
+	fmt.Printf("Requester:   %s\n", request.Requester)
+	fmt.Printf("Created:     %s\n", request.Created.Format(time.RFC3339))
+	fmt.Printf("Expires:     %s\n", request.Expires.Format(time.RFC3339))
+	fmt.Printf("Selector:    %s\n", request.Selector)
+	fmt.Printf("User:        %s\n", request.User)
+	fmt.Printf("Command:     %s\n", request.Command)
+	fmt.Printf("Hosts:       %s\n", strings.Join(request.Hosts, ","))
+}
+
+func approveCommand() cli.Command {
+	return cli.Command{
+		Name:      "approve",
+		Usage:     "Approve a run request with your key",
+		ArgsUsage: "FILE",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "key",
+				Value: dcrPath("key.json"),
+				Usage: "Sign with the key in `FILE`",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			file := c.Args().First()
+			if file == "" {
+				log.Fatalf("Error: run request file is required")
+			}
+			request, err := readRunRequest(file)
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			key, err := loadKey(c.String("key"))
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			if key.Name == request.Requested.Signer || key.PublicKey.Equal(request.Requested.PublicKey) {
+				log.Fatalf("Error: a run request cannot be approved by its requester")
+			}
+			printRunRequest(request.Request)
+			signature := request.Request.sign(key)
+			request.Approved = &signature
+			if err := writeRunRequest(file, request); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			fmt.Printf("Approved by %s\n", key.Name)
+			return nil
+		},
+	}
+}
+
+func keyCommand() cli.Command {
+	return cli.Command{
+		Name:  "key",
+		Usage: "Manage the signing key used for run approvals",
+		Subcommands: []cli.Command{
+			{
+				Name:      "generate",
+				Usage:     "Create a signing key",
+				ArgsUsage: "NAME",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "key",
+						Value: dcrPath("key.json"),
+						Usage: "Write the key to `FILE`",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					name := c.Args().First()
+					if name == "" {
+						name = currentUser()
+					}
+					if _, err := os.Stat(c.String("key")); err == nil {
+						log.Fatalf("Error: %s already exists", c.String("key"))
+					}
+					publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+					if err != nil {
+						log.Fatalf("Error: %v", err)
+					}
+					raw, _ := json.MarshalIndent(Key{Name: name, PublicKey: publicKey, PrivateKey: privateKey}, "", "  ")
+					if err := os.MkdirAll(filepath.Dir(c.String("key")), 0755); err != nil {
+						log.Fatalf("Error: %v", err)
+					}
+					if err := ioutil.WriteFile(c.String("key"), raw, 0600); err != nil {
+						log.Fatalf("Error: %v", err)
+					}
+					fmt.Printf("\"%s\": \"%s\"\n", name, base64.StdEncoding.EncodeToString(publicKey))
+					return nil
+				},
+			},
+			{
+				Name:  "show",
+				Usage: "Print the public key as a trusted_keys.json entry",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "key",
+						Value: dcrPath("key.json"),
+						Usage: "Read the key from `FILE`",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					key, err := loadKey(c.String("key"))
+					if err != nil {
+						log.Fatalf("Error: %v", err)
+					}
+					fmt.Printf("\"%s\": \"%s\"\n", key.Name, base64.StdEncoding.EncodeToString(key.PublicKey))
+					return nil
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testKey(t *testing.T, name string) Key {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Key{Name: name, PublicKey: publicKey, PrivateKey: privateKey}
+}
+
+func writeTrustedKeys(t *testing.T, file string, keys map[string]Key) {
+	encoded := map[string]string{}
+	for name, key := range keys {
+		encoded[name] = base64.StdEncoding.EncodeToString(key.PublicKey)
+	}
+	raw, _ := json.Marshal(encoded)
+	if err := ioutil.WriteFile(file, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApprovedRun(t *testing.T) {
+	alice, bob, mallory := testKey(t, "alice"), testKey(t, "bob"), testKey(t, "mallory")
+	servers := Servers{
+		{Name: "web01", Environment: "prod"},
+		{Name: "web02", Environment: "prod"},
+		{Name: "dev01", Environment: "dev"},
+	}
+	tests := []struct {
+		name      string
+		requester Key
+		approver  *Key
+		trusted   map[string]Key
+		servers   Servers
+		err       string
+	}{
+		{"approved", alice, &bob, map[string]Key{"alice": alice, "bob": bob}, servers, ""},
+		{"not approved", alice, nil, map[string]Key{"alice": alice, "bob": bob}, servers, "has not been approved"},
+		{"untrusted requester", mallory, &bob, map[string]Key{"alice": alice, "bob": bob}, servers, "requester mallory is not trusted"},
+		{"untrusted approver", alice, &mallory, map[string]Key{"alice": alice, "bob": bob}, servers, "approver mallory is not trusted"},
+		{"approved by requester", alice, &alice, map[string]Key{"alice": alice, "bob": bob}, servers, "approved by its requester"},
+		{"same key under two names", alice, &Key{Name: "carol", PublicKey: alice.PublicKey, PrivateKey: alice.PrivateKey}, map[string]Key{"alice": alice, "carol": alice}, servers, "approved by its requester"},
+		{"hosts changed", alice, &bob, map[string]Key{"alice": alice, "bob": bob}, append(servers, Server{Name: "web03", Environment: "prod"}), "inventory now resolves to web01,web02,web03"},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		trustedFile := filepath.Join(dir, "trusted_keys.json")
+		writeTrustedKeys(t, trustedFile, test.trusted)
+		request := RunRequest{
+			Command:   "uptime",
+			Selector:  Selector{Environment: "prod"},
+			User:      "app",
+			Hosts:     []string{"web01", "web02"},
+			Requester: test.requester.Name,
+			Created:   time.Now(),
+			Expires:   time.Now().Add(time.Hour),
+		}
+		requestFile := RunRequestFile{Request: request, Requested: request.sign(test.requester)}
+		if test.approver != nil {
+			signature := request.sign(*test.approver)
+			requestFile.Approved = &signature
+		}
+		file := filepath.Join(dir, "run.request.json")
+		if err := writeRunRequest(file, requestFile); err != nil {
+			t.Fatal(err)
+		}
+
+		run, err := approvedRun(file, trustedFile, test.servers)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: error = %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if run.Command != "uptime" || run.User != "app" || run.Approval == "" || strings.Join(serverNames(run.Servers), ",") != "web01,web02" {
+			t.Errorf("%s: run = %+v", test.name, run)
+		}
+	}
+}
+
+func TestUseRunRequest(t *testing.T) {
+	dir := t.TempDir()
+	if err := useRunRequest(dir, "abc"); err != nil {
+		t.Fatal(err)
+	}
+	if err := useRunRequest(dir, "abc"); err == nil || !strings.Contains(err.Error(), "already been used") {
+		t.Errorf("second use: error = %v, want already used", err)
+	}
+	if err := useRunRequest(dir, "def"); err != nil {
+		t.Errorf("other request: %v", err)
+	}
+}
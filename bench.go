@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+type BenchResult struct {
+	Server    string  `json:"server"`
+	Runs      int     `json:"runs"`
+	Errors    int     `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+	MinMs     float64 `json:"min_ms"`
+	P50Ms     float64 `json:"p50_ms"`
+	P95Ms     float64 `json:"p95_ms"`
+	MaxMs     float64 `json:"max_ms"`
+}
+
+// percentile uses the nearest-rank method on sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func benchServers(servers Servers, settingsFile string, user string, command string, runs int, concurrency int, timeout time.Duration) []BenchResult {
+	users := make([]string, len(servers))
+	for index, server := range servers {
+		users[index] = defaultUser(settingsFile, server.Environment, user)
+	}
+	durations := make([][]time.Duration, len(servers))
+	errors := make([]int, len(servers))
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	jobs := make(chan int)
+	for worker := 0; worker < concurrency; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range jobs {
+				start := time.Now()
+				exitCode, _, _ := execCommand(servers[index], users[index], command, nil, timeout)
+				elapsed := time.Since(start)
+				mutex.Lock()
+				durations[index] = append(durations[index], elapsed)
+				if exitCode != 0 {
+					errors[index]++
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for run := 0; run < runs; run++ {
+		for index := range servers {
+			jobs <- index
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	var results []BenchResult
+	for index, server := range servers {
+		sorted := durations[index]
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		results = append(results, BenchResult{
+			Server:    server.Name,
+			Runs:      len(sorted),
+			Errors:    errors[index],
+			ErrorRate: float64(errors[index]) / float64(len(sorted)),
+			MinMs:     milliseconds(percentile(sorted, 0)),
+			P50Ms:     milliseconds(percentile(sorted, 50)),
+			P95Ms:     milliseconds(percentile(sorted, 95)),
+			MaxMs:     milliseconds(percentile(sorted, 100)),
+		})
+	}
+	return results
+}
+
+func printBenchTable(results []BenchResult) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(writer, "SERVER\tRUNS\tERRORS\tMIN\tP50\tP95\tMAX\t")
+	for _, result := range results {
+		fmt.Fprintf(writer, "%s\t%d\t%d (%.0f%%)\t%.1fms\t%.1fms\t%.1fms\t%.1fms\t\n", result.Server, result.Runs, result.Errors, result.ErrorRate*100,
+			result.MinMs, result.P50Ms, result.P95Ms, result.MaxMs)
+	}
+	writer.Flush()
+}
+
+func benchCommand() cli.Command {
+	return cli.Command{
+		Name:      "bench",
+		Usage:     "Measure command latency on each server",
+		ArgsUsage: "[@TARGET] COMMAND",
+		Flags: append([]cli.Flag{
+			cli.IntFlag{
+				Name:  "n",
+				Value: 10,
+				Usage: "Run the command `N` times on each server",
+			},
+			cli.IntFlag{
+				Name:  "concurrency",
+				Value: 1,
+				Usage: "Keep up to `N` commands running at the same time",
+			},
+			cli.DurationFlag{
+				Name:  "timeout",
+				Usage: "Count a run as failed after `DURATION`",
+			},
+			cli.StringFlag{
+				Name:  "user, u",
+				Usage: "User to run as",
+			},
+			cli.StringFlag{
+				Name:  "format, f",
+				Usage: "Output format (table or json)",
+			},
+		}, append(lockFlags(), windowFlags()...)...),
+		Action: func(c *cli.Context) error {
+			args := c.Args()
+			target := ""
+			if strings.HasPrefix(args.First(), "@") {
+				target = args.First()
+				args = args.Tail()
+			}
+			command := args.First()
+			if command == "" {
+				log.Fatalf("Error: command is required for bench")
+			}
+			if c.Int("n") < 1 || c.Int("concurrency") < 1 {
+				log.Fatalf("Error: n and concurrency must be at least 1")
+			}
+			selector, err := resolveSelector(globalSelector(c), target)
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			servers := filterServers(getServers(c.GlobalString("config")), selector)
+			// bench runs any command, so it is held to the same rules as exec
+			// in every environment it reaches
+			settings, err := getSettings(c.GlobalString("settings"))
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			var environments []string
+			byEnvironment := map[string]Servers{}
+			for _, server := range servers {
+				if _, ok := byEnvironment[server.Environment]; !ok {
+					environments = append(environments, server.Environment)
+				}
+				byEnvironment[server.Environment] = append(byEnvironment[server.Environment], server)
+			}
+			for _, environment := range environments {
+				if settings.Environments[environment].RequireApproval {
+					log.Fatalf("Error: environment %s requires approval, bench cannot run there", environment)
+				}
+				if err := checkWindow(settings, environment, command, c.Bool("emergency"), c.String("reason")); err != nil {
+					log.Fatalf("Error: %v", err)
+				}
+			}
+			var held []*RunLocks
+			release := func() {
+				for _, locks := range held {
+					locks.Release()
+				}
+			}
+			for _, environment := range environments {
+				names, err := runLockNames(c.String("lock-scope"), environment, byEnvironment[environment])
+				if err == nil {
+					var locks *RunLocks
+					if locks, err = acquireRunLocks(c.GlobalString("lock-dir"), environment, names, command, c.Duration("lock-ttl")); err == nil {
+						held = append(held, locks)
+					}
+				}
+				if err != nil {
+					release()
+					log.Fatalf("Error: %v", err)
+				}
+			}
+			defer release()
+			defer onInterrupt(func(os.Signal) { release() })()
+			results := benchServers(servers, c.GlobalString("settings"), c.String("user"), command, c.Int("n"), c.Int("concurrency"), c.Duration("timeout"))
+			if c.String("format") == "json" {
+				resultsJSON, err := json.MarshalIndent(results, "", "  ")
+				if err != nil {
+					return cli.NewExitError(fmt.Sprintf("Error: %v", err), 1)
+				}
+				fmt.Println(string(resultsJSON))
+				return nil
+			}
+			printBenchTable(results)
+			return nil
+		},
+	}
+}
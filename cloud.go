@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// CloudInstance is an instance from a cloud listing, before it becomes a
+// server.
+type CloudInstance struct {
+	Name string
+	Zone string
+	Tags map[string]string
+	// NetworkTags are tags without a value, such as GCE network tags.
+	NetworkTags []string
+}
+
+// ImportRules decide how instance tags become the environment, tags and
+// labels of a server.
+type ImportRules struct {
+	EnvTags     []string
+	EnvMap      map[string]string
+	Environment string
+	TagsFrom    []string
+	NameTag     string
+}
+
+type ec2Listing struct {
+	Reservations []struct {
+		Instances []struct {
+			InstanceId       string
+			PrivateDnsName   string
+			PrivateIpAddress string
+			State            struct{ Name string }
+			Placement        struct{ AvailabilityZone string }
+			Tags             []struct{ Key, Value string }
+		}
+	}
+}
+
+type gceInstance struct {
+	Name   string            `json:"name"`
+	Zone   string            `json:"zone"`
+	Status string            `json:"status"`
+	Labels map[string]string `json:"labels"`
+	Tags   struct {
+		Items []string `json:"items"`
+	} `json:"tags"`
+}
+
+type azureVM struct {
+	Name       string            `json:"name"`
+	Location   string            `json:"location"`
+	PowerState string            `json:"powerState"`
+	Tags       map[string]string `json:"tags"`
+}
+
+// ec2Instances reads the output of aws ec2 describe-instances. Instances are
+// named by their private DNS name, the one reachable from inside the VPC.
+func ec2Instances(raw []byte) ([]CloudInstance, error) {
+	var listing ec2Listing
+	if err := json.Unmarshal(raw, &listing); err != nil {
+		return nil, err
+	}
+	var instances []CloudInstance
+	for _, reservation := range listing.Reservations {
+		for _, instance := range reservation.Instances {
+			if instance.State.Name != "running" {
+				continue
+			}
+			tags := map[string]string{}
+			for _, tag := range instance.Tags {
+				tags[tag.Key] = tag.Value
+			}
+			name := instance.PrivateDnsName
+			if name == "" {
+				name = instance.PrivateIpAddress
+			}
+			if name == "" {
+				name = instance.InstanceId
+			}
+			instances = append(instances, CloudInstance{Name: name, Zone: instance.Placement.AvailabilityZone, Tags: tags})
+		}
+	}
+	return instances, nil
+}
+
+// gceInstances reads the output of gcloud compute instances list --format=json.
+func gceInstances(raw []byte) ([]CloudInstance, error) {
+	var listing []gceInstance
+	if err := json.Unmarshal(raw, &listing); err != nil {
+		return nil, err
+	}
+	var instances []CloudInstance
+	for _, instance := range listing {
+		if instance.Status != "RUNNING" {
+			continue
+		}
+		instances = append(instances, CloudInstance{
+			Name:        instance.Name,
+			Zone:        path.Base(instance.Zone),
+			Tags:        instance.Labels,
+			NetworkTags: instance.Tags.Items,
+		})
+	}
+	return instances, nil
+}
+
+// azureInstances reads the output of az vm list. The power state is only
+// known with --show-details, without it all VMs are imported.
+func azureInstances(raw []byte) ([]CloudInstance, error) {
+	var listing []azureVM
+	if err := json.Unmarshal(raw, &listing); err != nil {
+		return nil, err
+	}
+	var instances []CloudInstance
+	for _, vm := range listing {
+		if vm.PowerState != "" && vm.PowerState != "VM running" {
+			continue
+		}
+		instances = append(instances, CloudInstance{Name: vm.Name, Zone: vm.Location, Tags: vm.Tags})
+	}
+	return instances, nil
+}
+
+var cloudProviders = map[string]func([]byte) ([]CloudInstance, error){
+	"aws-ec2": ec2Instances,
+	"gce":     gceInstances,
+	"azure":   azureInstances,
+}
+
+// tagValue looks a tag up ignoring case, as clouds differ in how tag keys
+// are usually written.
+func tagValue(tags map[string]string, key string) (string, bool) {
+	if value, ok := tags[key]; ok {
+		return value, true
+	}
+	for name, value := range tags {
+		if strings.EqualFold(name, key) {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+func (rules ImportRules) environment(instance CloudInstance) string {
+	for _, key := range rules.EnvTags {
+		if value, ok := tagValue(instance.Tags, key); ok && value != "" {
+			if mapped, ok := rules.EnvMap[strings.ToLower(value)]; ok {
+				return mapped
+			}
+			return value
+		}
+	}
+	return rules.Environment
+}
+
+// server turns an instance into a server. All instance tags become labels,
+// the zone is kept in the zone label unless a tag sets it. The values of the
+// TagsFrom tags, split on commas, become its tags.
+func (rules ImportRules) server(instance CloudInstance) Server {
+	server := Server{
+		Name:        instance.Name,
+		Environment: rules.environment(instance),
+		Tags:        Tags{},
+		Labels:      Labels{},
+	}
+	if instance.Zone != "" {
+		server.Labels["zone"] = instance.Zone
+	}
+	for key, value := range instance.Tags {
+		server.Labels[key] = value
+	}
+	if rules.NameTag != "" {
+		if name, ok := tagValue(instance.Tags, rules.NameTag); ok && name != "" {
+			server.Name = name
+		}
+	}
+	server.Tags = append(server.Tags, instance.NetworkTags...)
+	for _, key := range rules.TagsFrom {
+		if value, ok := tagValue(instance.Tags, key); ok {
+			server.Tags = append(server.Tags, splitList(value)...)
+		}
+	}
+	if len(server.Labels) == 0 {
+		server.Labels = nil
+	}
+	return server
+}
+
+func parseEnvMap(rules []string) (map[string]string, error) {
+	envMap := map[string]string{}
+	for _, rule := range rules {
+		for _, pair := range splitList(rule) {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				return nil, fmt.Errorf("invalid environment mapping %q, use VALUE=ENV", pair)
+			}
+			envMap[strings.ToLower(parts[0])] = parts[1]
+		}
+	}
+	return envMap, nil
+}
+
+func importCommand() cli.Command {
+	var providers []string
+	for name := range cloudProviders {
+		providers = append(providers, name)
+	}
+	sort.Strings(providers)
+	return cli.Command{
+		Name:      "import",
+		Usage:     "Convert a cloud instance listing into servers",
+		ArgsUsage: "FILE",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "from",
+				Usage: "Format of the listing: " + strings.Join(providers, ", "),
+			},
+			cli.StringSliceFlag{
+				Name:  "env-tag",
+				Usage: "Take the environment from instance tag `KEY`, the first one set wins (default: Env, Environment)",
+			},
+			cli.StringSliceFlag{
+				Name:  "env-map",
+				Usage: "Rename environments taken from tags, as `VALUE=ENV` pairs",
+			},
+			cli.StringSliceFlag{
+				Name:  "tags-from",
+				Usage: "Split the value of instance tag `KEY` on commas into tags (default: Tags, Role)",
+			},
+			cli.StringFlag{
+				Name:  "name-tag",
+				Usage: "Name servers by instance tag `KEY` instead of their host name",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			provider, ok := cloudProviders[c.String("from")]
+			if !ok {
+				log.Fatalf("Error: --from must be one of %s", strings.Join(providers, ", "))
+			}
+			if c.NArg() != 1 {
+				log.Fatalf("Error: listing file is required")
+			}
+			raw, err := ioutil.ReadFile(c.Args().First())
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			instances, err := provider(raw)
+			if err != nil {
+				log.Fatalf("Error: %s: %v", c.Args().First(), err)
+			}
+			envMap, err := parseEnvMap(c.StringSlice("env-map"))
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			rules := ImportRules{
+				EnvTags:     c.StringSlice("env-tag"),
+				EnvMap:      envMap,
+				Environment: c.GlobalString("env"),
+				TagsFrom:    c.StringSlice("tags-from"),
+				NameTag:     c.String("name-tag"),
+			}
+			if len(rules.EnvTags) == 0 {
+				rules.EnvTags = []string{"Env", "Environment"}
+			}
+			if len(rules.TagsFrom) == 0 {
+				rules.TagsFrom = []string{"Tags", "Role"}
+			}
+
+			var servers Servers
+			for _, instance := range instances {
+				server := rules.server(instance)
+				if server.Environment == "" {
+					fmt.Fprintf(os.Stderr, "Skipping %s: no environment tag, use --env for a default\n", server.Name)
+					continue
+				}
+				servers = append(servers, server)
+			}
+			printInventory(servers)
+			return nil
+		},
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+const labelColumnPrefix = "labels."
+
+// checkColumns rejects column names list cannot show.
+func checkColumns(columns []string) error {
+	for _, column := range columns {
+		switch column {
+		case "name", "env", "environment", "tags", "labels", "disabled", "reason":
+		default:
+			if !strings.HasPrefix(column, labelColumnPrefix) || column == labelColumnPrefix {
+				return fmt.Errorf("unknown column %q, use name, env, tags, labels, labels.KEY, disabled or reason", column)
+			}
+		}
+	}
+	return nil
+}
+
+func columnString(server Server, column string) string {
+	switch column {
+	case "name":
+		return server.Name
+	case "env", "environment":
+		return server.Environment
+	case "tags":
+		return strings.Join(server.Tags, ",")
+	case "labels":
+		var pairs []string
+		for _, key := range sortedLabelKeys(server.Labels) {
+			pairs = append(pairs, key+"="+server.Labels[key])
+		}
+		return strings.Join(pairs, ",")
+	case "disabled":
+		return fmt.Sprint(server.isDisabled())
+	case "reason":
+		return server.disabledReason()
+	}
+	value, ok := server.Labels[strings.TrimPrefix(column, labelColumnPrefix)]
+	if !ok {
+		return "-"
+	}
+	return value
+}
+
+func sortedLabelKeys(labels Labels) []string {
+	var keys []string
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sortServers orders servers by the given columns, keeping the order of the
+// servers file among equal ones.
+func sortServers(servers Servers, columns []string) Servers {
+	sorted := append(Servers(nil), servers...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		for _, column := range columns {
+			a, b := columnString(sorted[i], column), columnString(sorted[j], column)
+			if a != b {
+				return a < b
+			}
+		}
+		return false
+	})
+	return sorted
+}
+
+// projectServers keeps only the selected columns of each server, under the
+// same keys as in the servers file.
+func projectServers(servers Servers, columns []string) []map[string]interface{} {
+	projected := []map[string]interface{}{}
+	for _, server := range servers {
+		entry := map[string]interface{}{}
+		for _, column := range columns {
+			switch column {
+			case "name":
+				entry["name"] = server.Name
+			case "env", "environment":
+				entry["environment"] = server.Environment
+			case "tags":
+				entry["tags"] = server.Tags
+			case "labels":
+				entry["labels"] = server.Labels
+			case "disabled":
+				entry["disabled"] = server.isDisabled()
+			case "reason":
+				entry["reason"] = server.disabledReason()
+			default:
+				if _, all := entry["labels"].(Labels); all {
+					continue
+				}
+				labels, ok := entry["labels"].(map[string]string)
+				if !ok {
+					labels = map[string]string{}
+					entry["labels"] = labels
+				}
+				key := strings.TrimPrefix(column, labelColumnPrefix)
+				if value, ok := server.Labels[key]; ok {
+					labels[key] = value
+				}
+			}
+		}
+		projected = append(projected, entry)
+	}
+	return projected
+}
+
+func tableOutput(servers Servers, columns []string, header bool) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if header {
+		fmt.Fprintln(writer, strings.ToUpper(strings.Join(columns, "\t")))
+	}
+	for _, server := range servers {
+		values := make([]string, len(columns))
+		for index, column := range columns {
+			values[index] = columnString(server, column)
+		}
+		fmt.Fprintln(writer, strings.Join(values, "\t"))
+	}
+	writer.Flush()
+}
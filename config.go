@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// inventoryVersion is the current version of the servers file format.
+// Version 1 is the original bare array of servers, which is still accepted.
+const inventoryVersion = 2
+
+type Inventory struct {
+	Version InventoryVersion `json:"version" description:"Version of the servers file format"`
+	Servers Servers          `json:"servers" description:"Servers to run commands on"`
+}
+
+// InventoryVersion is the version of a servers file. Its schema only allows
+// the current version.
+type InventoryVersion int
+
+func (InventoryVersion) jsonSchema() map[string]interface{} {
+	return map[string]interface{}{"type": "integer", "enum": []interface{}{inventoryVersion}}
+}
+
+type rawInventory struct {
+	Version int             `json:"version"`
+	Servers json.RawMessage `json:"servers"`
+}
+
+func parseInventory(raw []byte) (Inventory, error) {
+	var inventory Inventory
+	trimmed := bytes.TrimSpace(raw)
+	if bytes.HasPrefix(trimmed, []byte("[")) {
+		inventory.Version = 1
+		err := json.Unmarshal(trimmed, &inventory.Servers)
+		return inventory, err
+	}
+	if err := json.Unmarshal(trimmed, &inventory); err != nil {
+		return inventory, err
+	}
+	if inventory.Version == 0 {
+		return inventory, errors.New("missing version")
+	}
+	if inventory.Version > inventoryVersion {
+		return inventory, fmt.Errorf("version %d is newer than this dcr supports (%d)", inventory.Version, inventoryVersion)
+	}
+	return inventory, nil
+}
+
+// migrateInventory rewrites a servers file into the current format. Servers
+// are carried over verbatim so that no field is lost on the way.
+func migrateInventory(raw []byte) ([]byte, error) {
+	trimmed := bytes.TrimSpace(raw)
+	current := rawInventory{Version: inventoryVersion, Servers: trimmed}
+	if !bytes.HasPrefix(trimmed, []byte("[")) {
+		if err := json.Unmarshal(trimmed, &current); err != nil {
+			return nil, err
+		}
+		current.Version = inventoryVersion
+	}
+	migrated, err := json.MarshalIndent(current, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(migrated, '\n'), nil
+}
+
+// diffLines returns a line diff of a and b, each line prefixed by "-", "+"
+// or " ". Inputs too large to compare are shown as fully replaced.
+func diffLines(a []string, b []string) []string {
+	var diff []string
+	if len(a)*len(b) > 4000000 {
+		for _, line := range a {
+			diff = append(diff, "-"+line)
+		}
+		for _, line := range b {
+			diff = append(diff, "+"+line)
+		}
+		return diff
+	}
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i] == b[j] {
+			diff = append(diff, " "+a[i])
+			i++
+			j++
+		} else if lcs[i+1][j] >= lcs[i][j+1] {
+			diff = append(diff, "-"+a[i])
+			i++
+		} else {
+			diff = append(diff, "+"+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		diff = append(diff, "-"+a[i])
+	}
+	for ; j < len(b); j++ {
+		diff = append(diff, "+"+b[j])
+	}
+	return diff
+}
+
+func confirm(prompt string) bool {
+	fmt.Printf("%s [y/N] ", prompt)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func configCommand() cli.Command {
+	return cli.Command{
+		Name:  "config",
+		Usage: "Maintain the servers file",
+		Subcommands: append([]cli.Command{
+			{
+				Name:  "schema",
+				Usage: "Print the JSON Schema of the servers file",
+				Action: func(c *cli.Context) error {
+					schema, err := json.MarshalIndent(inventorySchema(), "", "  ")
+					if err != nil {
+						log.Fatalf("Error: %v", err)
+					}
+					fmt.Println(string(schema))
+					return nil
+				},
+			},
+			{
+				Name:  "migrate",
+				Usage: "Rewrite the servers file in the current format",
+				Flags: []cli.Flag{
+					cli.BoolFlag{
+						Name:  "dry-run, n",
+						Usage: "Only show the changes",
+					},
+					cli.BoolFlag{
+						Name:  "yes, y",
+						Usage: "Write the changes without asking",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					configFile := c.GlobalString("config")
+					raw, err := ioutil.ReadFile(configFile)
+					if err != nil {
+						log.Fatalf("Error: %v", err)
+					}
+					inventory, err := parseInventory(raw)
+					if err != nil {
+						log.Fatalf("Error: %s: %v", configFile, err)
+					}
+					if inventory.Version == inventoryVersion {
+						fmt.Printf("%s is already at version %d\n", configFile, inventoryVersion)
+						return nil
+					}
+					migrated, err := migrateInventory(raw)
+					if err != nil {
+						log.Fatalf("Error: %s: %v", configFile, err)
+					}
+
+					fmt.Printf("--- %s (version %d)\n+++ %s (version %d)\n", configFile, inventory.Version, configFile, inventoryVersion)
+					before := strings.Split(strings.TrimRight(string(raw), "\n"), "\n")
+					after := strings.Split(strings.TrimRight(string(migrated), "\n"), "\n")
+					for _, line := range diffLines(before, after) {
+						fmt.Println(line)
+					}
+					if c.Bool("dry-run") {
+						return nil
+					}
+					if !c.Bool("yes") && !confirm("Write changes to "+configFile+"?") {
+						return nil
+					}
+					if err := ioutil.WriteFile(configFile+".bak", raw, 0644); err != nil {
+						log.Fatalf("Error: %v", err)
+					}
+					if err := ioutil.WriteFile(configFile, migrated, 0644); err != nil {
+						log.Fatalf("Error: %v", err)
+					}
+					fmt.Printf("Migrated %s, the original is in %s.bak\n", configFile, configFile)
+					return nil
+				},
+			},
+		}, secretCommands()...),
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kr/pty"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+func fuzzyMatch(name string, query string) bool {
+	name = strings.ToLower(name)
+	for _, r := range strings.ToLower(query) {
+		index := strings.IndexRune(name, r)
+		if index < 0 {
+			return false
+		}
+		name = name[index+1:]
+	}
+	return true
+}
+
+func fuzzyFilter(servers Servers, query string) Servers {
+	var matched Servers
+	for _, server := range servers {
+		if fuzzyMatch(server.Name, query) {
+			matched = append(matched, server)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		iContains := strings.Contains(strings.ToLower(matched[i].Name), strings.ToLower(query))
+		jContains := strings.Contains(strings.ToLower(matched[j].Name), strings.ToLower(query))
+		if iContains != jContains {
+			return iContains
+		}
+		return len(matched[i].Name) < len(matched[j].Name)
+	})
+	return matched
+}
+
+func pickServer(servers Servers, query string, in *bufio.Reader) (Server, error) {
+	for _, server := range servers {
+		if server.Name == query {
+			return server, nil
+		}
+	}
+
+	candidates := fuzzyFilter(servers, query)
+	for {
+		if len(candidates) == 0 {
+			return Server{}, errors.New("no server matches")
+		}
+		if len(candidates) == 1 {
+			return candidates[0], nil
+		}
+		for index, server := range candidates {
+			fmt.Printf("%3d) %s %s %s\n", index+1, server.Environment, server.Name, server.Tags)
+		}
+		fmt.Print("Select server (number or filter): ")
+		line, err := in.ReadString('\n')
+		if err != nil && line == "" {
+			return Server{}, err
+		}
+		line = strings.TrimSpace(line)
+		if number, err := strconv.Atoi(line); err == nil && number >= 1 && number <= len(candidates) {
+			return candidates[number-1], nil
+		}
+		if line != "" {
+			candidates = fuzzyFilter(candidates, line)
+		}
+	}
+}
+
+func logConnection(server Server, remoteUser string) error {
+	file := dcrPath("connections.log")
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	logFile, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	_, err = fmt.Fprintf(logFile, "%s %s %s %s %s\n", time.Now().Format(time.RFC3339), currentUser(), server.Environment, server.Name, remoteUser)
+	return err
+}
+
+func interactiveSession(server Server, remoteUser string, record io.Writer) error {
+	cmd := transportCommand(server, remoteUser, "")
+	ptmx, err := pty.Start(cmd)
+	if err != nil {
+		return err
+	}
+	defer ptmx.Close()
+
+	resize := make(chan os.Signal, 1)
+	signal.Notify(resize, syscall.SIGWINCH)
+	defer signal.Stop(resize)
+	go func() {
+		for range resize {
+			pty.InheritSize(os.Stdin, ptmx)
+		}
+	}()
+	resize <- syscall.SIGWINCH
+
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		state, err := terminal.MakeRaw(int(os.Stdin.Fd()))
+		if err != nil {
+			return err
+		}
+		defer terminal.Restore(int(os.Stdin.Fd()), state)
+	}
+
+	output := io.Writer(os.Stdout)
+	if record != nil {
+		output = io.MultiWriter(os.Stdout, record)
+	}
+	go io.Copy(ptmx, os.Stdin)
+	io.Copy(output, ptmx)
+	return cmd.Wait()
+}
+
+func connectCommand() cli.Command {
+	return cli.Command{
+		Name:      "connect",
+		Aliases:   []string{"ssh"},
+		Usage:     "Open an interactive session on a server",
+		ArgsUsage: "[NAME or filter]",
+		Flags: append([]cli.Flag{
+			cli.StringFlag{
+				Name:  "user, u",
+				Usage: "User to run as",
+			},
+		}, recordFlags()...),
+		Action: func(c *cli.Context) error {
+			servers := selectedServers(c)
+			server, err := pickServer(servers, c.Args().First(), bufio.NewReader(os.Stdin))
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			remoteUser := defaultUser(c.GlobalString("settings"), server.Environment, c.String("user"))
+			if err := logConnection(server, remoteUser); err != nil {
+				log.Printf("Warning: could not log connection: %v", err)
+			}
+			var record io.Writer
+			if c.Bool("record") {
+				recorder, err := newRecorder(c.String("record-dir"), server.Name, "dcr connect "+server.Name, false)
+				if err != nil {
+					log.Fatalf("Error: %v", err)
+				}
+				defer recorder.Close()
+				record = recorder
+			}
+			err = interactiveSession(server, remoteUser, record)
+			exitCode := 0
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				exitCode = exitErr.ExitCode()
+			} else if err != nil {
+				exitCode = 255
+			}
+			recordContact(server, Contact{Via: "connect", User: remoteUser, ExitCode: exitCode})
+			return err
+		},
+	}
+}
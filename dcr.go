@@ -4,41 +4,85 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"os/user"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/aybabtme/rgbterm"
 	"github.com/urfave/cli"
 )
 
 type Server struct {
-	Name        string `json:"name"`
-	Environment string `json:"environment"`
-	Tags        Tags   `json:"tags"`
+	Name        string             `json:"name" description:"Host name passed to the transport"`
+	Environment string             `json:"environment" description:"Environment selected with --env"`
+	Tags        Tags               `json:"tags" optional:"true" description:"Tags selected with --tags"`
+	Labels      Labels             `json:"labels,omitempty" description:"Key/value labels selected with --labels"`
+	Disabled    bool               `json:"disabled,omitempty" description:"Skip the server unless --include-disabled is given"`
+	Reason      string             `json:"reason,omitempty" description:"Why the server is disabled"`
+	Password    *Secret            `json:"password,omitempty" description:"Password for the server"`
+	Secrets     map[string]*Secret `json:"secrets,omitempty" description:"Other credentials for the server, such as tokens"`
+	Transport   TransportName      `json:"transport,omitempty" description:"Transport to reach the server with, instead of --transport"`
+	Container   string             `json:"container,omitempty" description:"Container to run in (docker: defaults to the name)"`
+	Pod         string             `json:"pod,omitempty" description:"Pod to run in (kubectl: defaults to the name)"`
+	Namespace   string             `json:"namespace,omitempty" description:"Namespace of the pod (kubectl)"`
+	Context     string             `json:"context,omitempty" description:"kubeconfig context of the pod (kubectl)"`
+
+	quarantine *Quarantine
 }
 
 type Servers []Server
 
 type Tags []string
 
+func dcrPath(name string) string {
+	return filepath.Join(os.Getenv("HOME"), ".dcr", name)
+}
+
+func currentUser() string {
+	if current, err := user.Current(); err == nil {
+		return current.Username
+	}
+	return os.Getenv("USER")
+}
+
+func currentOwner() string {
+	hostname, _ := os.Hostname()
+	return currentUser() + "@" + hostname
+}
+
 func getServers(configFile string) Servers {
 	raw, err := ioutil.ReadFile(configFile)
 	if err != nil {
 		fmt.Println(err.Error())
 		os.Exit(1)
 	}
-	var servers []Server
-	json.Unmarshal(raw, &servers)
-	return servers
+	inventory, err := parseInventory(raw)
+	if err != nil {
+		fmt.Printf("%s: %v\n", configFile, err)
+		os.Exit(1)
+	}
+	if err := decryptServers(inventory.Servers); err != nil {
+		fmt.Printf("%s: %v\n", configFile, err)
+		os.Exit(1)
+	}
+	if err := checkTransports(inventory.Servers); err != nil {
+		fmt.Printf("%s: %v\n", configFile, err)
+		os.Exit(1)
+	}
+	return applyQuarantine(inventory.Servers)
 }
 
 func filterByEnvironment(servers Servers, environment string) Servers {
-	filtered := servers[:0]
+	var filtered Servers
 	for _, server := range servers {
 		if server.Environment == environment {
 			filtered = append(filtered, server)
@@ -58,7 +102,7 @@ func contains(tags []string, expectedTag string) bool {
 }
 
 func filterByTag(servers Servers, tag string) Servers {
-	filtered := servers[:0]
+	var filtered Servers
 	for _, server := range servers {
 		if strings.HasPrefix(tag, "!") {
 			if !contains(server.Tags, strings.TrimPrefix(tag, "!")) {
@@ -93,51 +137,140 @@ func printJSONOutput(servers Servers) {
 	fmt.Println(string(serversJSON))
 }
 
-func columnarOutput(servers Servers) {
+func columnarOutput(servers Servers, labelColumns []string) {
 	for _, server := range servers {
-		fmt.Printf("%s %s %s\n", server.Environment, server.Name, server.Tags)
+		fmt.Printf("%s %s %s", server.Environment, server.Name, server.Tags)
+		for _, label := range labelColumns {
+			value, ok := server.Labels[label]
+			if !ok {
+				value = "-"
+			}
+			fmt.Printf(" %s", value)
+		}
+		fmt.Println("")
 	}
 }
 
-func formatList(servers Servers, format string) {
+func formatList(servers Servers, format string, labelColumns []string, columns []string, header bool) {
 	if format == "names" {
 		listNamesOutput(servers)
+	} else if format == "json" && len(columns) != 0 {
+		projected, err := json.MarshalIndent(projectServers(servers, columns), "", "  ")
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		fmt.Println(string(projected))
 	} else if format == "json" {
 		printJSONOutput(servers)
+	} else if len(columns) != 0 {
+		tableOutput(servers, columns, header)
 	} else {
-		columnarOutput(servers)
+		columnarOutput(servers, labelColumns)
+	}
+}
+
+func filterByName(servers Servers, excluded []string) Servers {
+	var filtered Servers
+	for _, server := range servers {
+		if !contains(excluded, server.Name) {
+			filtered = append(filtered, server)
+		}
 	}
+	return filtered
 }
 
-func filterServers(servers Servers, environment string, tags []string) Servers {
-	filtered := servers[:0]
-	filtered = servers
-	if environment != "" {
-		filtered = filterByEnvironment(filtered, environment)
+func filterServers(servers Servers, selector Selector) Servers {
+	filtered := servers
+	if selector.Environment != "" {
+		filtered = filterByEnvironment(filtered, selector.Environment)
 	}
-	if tags != nil && len(tags) != 0 {
-		for _, tag := range tags {
+	if selector.Tags != nil && len(selector.Tags) != 0 {
+		for _, tag := range selector.Tags {
 			if strings.TrimSpace(tag) != "" {
 				filtered = filterByTag(filtered, tag)
 			}
 
 		}
 	}
+	if selector.Labels != "" {
+		requirements, err := parseLabelSelector(selector.Labels)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		filtered = filterByLabels(filtered, requirements)
+	}
+	if len(selector.Exclude) != 0 {
+		filtered = filterByName(filtered, selector.Exclude)
+	}
+	if !selector.IncludeDisabled {
+		filtered = filterDisabled(filtered)
+	}
 	return filtered
 }
 
-func execCommand(server Server, user string, command string) (exitCode int, stdout string, stderr string) {
+func selectedServers(c *cli.Context) Servers {
+	servers := getServers(c.GlobalString("config"))
+	return filterServers(servers, globalSelector(c))
+}
+
+// ProcessGroups are the process groups of the running transports. They are
+// not in the group of dcr, so they are signalled separately when it stops.
+type ProcessGroups struct {
+	mutex sync.Mutex
+	pids  map[int]bool
+}
+
+var processGroups = &ProcessGroups{pids: map[int]bool{}}
+
+func (g *ProcessGroups) add(pid int) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.pids[pid] = true
+}
+
+func (g *ProcessGroups) remove(pid int) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	delete(g.pids, pid)
+}
+
+func (g *ProcessGroups) kill(signal syscall.Signal) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for pid := range g.pids {
+		syscall.Kill(-pid, signal)
+	}
+}
+
+func execCommand(server Server, user string, command string, record io.Writer, timeout time.Duration) (exitCode int, stdout string, stderr string) {
 	var stdoutBuf bytes.Buffer
 	var stderrBuf bytes.Buffer
 
 	exit := 0
 
-	cmd := exec.Command("pmrun", "-h", server.Name, user, command)
+	cmd := transportCommand(server, user, command)
 	cmd.Stdout = &stdoutBuf
 	cmd.Stderr = &stderrBuf
+	if record != nil {
+		cmd.Stdout = io.MultiWriter(&stdoutBuf, record)
+		cmd.Stderr = io.MultiWriter(&stderrBuf, record)
+	}
+	if timeout > 0 {
+		// run in a process group of its own, so that the timeout also
+		// kills whatever the transport started
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
 	startErr := cmd.Start()
 	if startErr != nil {
-		log.Fatalf("cmd.Start: %v", startErr)
+		return 255, "", fmt.Sprintf("cmd.Start: %v", startErr)
+	}
+	var timer *time.Timer
+	if timeout > 0 {
+		processGroups.add(cmd.Process.Pid)
+		defer processGroups.remove(cmd.Process.Pid)
+		timer = time.AfterFunc(timeout, func() {
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		})
 	}
 	er := cmd.Wait()
 	if er != nil {
@@ -147,6 +280,10 @@ func execCommand(server Server, user string, command string) (exitCode int, stdo
 			}
 		}
 	}
+	if timer != nil && !timer.Stop() {
+		exit = 124
+		stderrBuf.WriteString(fmt.Sprintf("\ntimed out after %s", timeout))
+	}
 
 	return exit, stdoutBuf.String(), stderrBuf.String()
 }
@@ -184,7 +321,7 @@ func main() {
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
 			Name:        "config, c",
-			Value:       os.Getenv("HOME") + "/.dcr/servers.json",
+			Value:       dcrPath("servers.json"),
 			Usage:       "Load configuration from `FILE`",
 			Destination: &configFile,
 		},
@@ -198,6 +335,36 @@ func main() {
 			Usage:       "Filter by tags",
 			Destination: &tags,
 		},
+		cli.StringFlag{
+			Name:  "labels, l",
+			Usage: "Filter by label `SELECTOR`, e.g. 'role=web,tier!=backend,version in (2.3,2.4),!legacy'",
+		},
+		cli.StringFlag{
+			Name:  "exclude",
+			Usage: "Skip the comma separated server `NAMES`",
+		},
+		cli.BoolFlag{
+			Name:  "include-disabled",
+			Usage: "Select disabled and quarantined servers too",
+		},
+		cli.StringFlag{
+			Name:  "settings, s",
+			Value: dcrPath("settings.json"),
+			Usage: "Load environment settings from `FILE`",
+		},
+		cli.StringFlag{
+			Name:  "lock-dir",
+			Value: dcrPath("locks"),
+			Usage: "Keep run locks in `DIR`, which may be shared between machines",
+		},
+	}
+
+	app.Flags = append(app.Flags, transportFlags()...)
+	app.Before = func(c *cli.Context) error {
+		if err := setupTransport(c); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return nil
 	}
 
 	app.Commands = []cli.Command{
@@ -211,44 +378,115 @@ func main() {
 					Usage:       "Output format",
 					Destination: &format,
 				},
+				cli.StringFlag{
+					Name:  "label-columns, L",
+					Usage: "Show the comma separated label `KEYS` as columns",
+				},
+				cli.StringFlag{
+					Name:  "columns",
+					Usage: "Show only the comma separated `COLUMNS` (name, env, tags, labels, labels.KEY, disabled, reason)",
+				},
+				cli.StringFlag{
+					Name:  "sort",
+					Usage: "Sort by the comma separated `COLUMNS`",
+				},
+				cli.IntFlag{
+					Name:  "limit",
+					Usage: "Show at most `N` servers",
+				},
+				cli.BoolFlag{
+					Name:  "no-header",
+					Usage: "Do not print the header line of --columns",
+				},
 			},
+			ArgsUsage: "[@TARGET]",
 			Action: func(c *cli.Context) error {
+				selector, err := resolveSelector(globalSelector(c), c.Args().First())
+				if err != nil {
+					log.Fatalf("Error: %v", err)
+				}
+				columns := splitList(c.String("columns"))
+				if len(columns) != 0 {
+					for _, label := range splitList(c.String("label-columns")) {
+						columns = append(columns, labelColumnPrefix+label)
+					}
+				}
+				sortColumns := splitList(c.String("sort"))
+				if err := checkColumns(append(columns, sortColumns...)); err != nil {
+					log.Fatalf("Error: %v", err)
+				}
 				servers := getServers(configFile)
-				servers = filterServers(servers, environment, strings.Split(tags, ","))
-				formatList(servers, format)
+				servers = filterServers(servers, selector)
+				servers = sortServers(servers, sortColumns)
+				if c.Int("limit") > 0 && len(servers) > c.Int("limit") {
+					servers = servers[:c.Int("limit")]
+				}
+				formatList(servers, format, splitList(c.String("label-columns")), columns, !c.Bool("no-header"))
 				fmt.Println("")
 				return nil
 			},
 		},
 		{
 			Name:    "exec",
-			Aliases: []string{"x", "run"},
+			Aliases: []string{"x"},
 			Usage:   "Execute command",
-			Flags: []cli.Flag{
+			Flags: append([]cli.Flag{
 				cli.StringFlag{
 					Name:        "user, u",
 					Usage:       "User to run as",
 					Destination: &user,
 				},
-			},
+			}, append(execFlags(), approvedFlags()...)...),
+			ArgsUsage: "[@TARGET] COMMAND",
 			Action: func(c *cli.Context) error {
-				if environment == "" {
-					log.Fatalf("Error: environment flag is required for exec")
+				args := c.Args()
+				target := ""
+				if strings.HasPrefix(args.First(), "@") {
+					target = args.First()
+					args = args.Tail()
 				}
-				cmd := c.Args().Get(0)
+				cmd := args.Get(0)
 				servers := getServers(configFile)
-				servers = filterServers(servers, environment, strings.Split(tags, ","))
-				for _, server := range servers {
-					exitCode, stdout, stderr := execCommand(server, user, cmd)
-					fmt.Printf("\n%2s[%10s] STDOUT: %10s\n", colorizeExitCode(exitCode), server.Name, strings.Trim(stdout, "\n"))
-					if stderr != "" {
-						fmt.Printf("STDERR: %s\n", strings.Trim(stderr, "\n"))
+				if c.String("approved") != "" {
+					run, err := approvedRun(c.String("approved"), c.String("trusted-keys"), servers)
+					if err != nil {
+						log.Fatalf("Error: %v", err)
 					}
+					if cmd != "" && cmd != run.Command {
+						log.Fatalf("Error: command differs from the approved command %q", run.Command)
+					}
+					return runExec(c, run)
 				}
-				fmt.Println("")
-				return nil
+				selector, err := resolveSelector(globalSelector(c), target)
+				if err != nil {
+					log.Fatalf("Error: %v", err)
+				}
+				if selector.Environment == "" {
+					log.Fatalf("Error: environment flag is required for exec")
+				}
+				runUser := defaultUser(c.GlobalString("settings"), selector.Environment, user)
+				return requestOrExec(c, newRun(servers, selector, cmd, runUser), selector)
 			},
 		},
+		tunnelCommand(),
+		connectCommand(),
+		lockCommand(),
+		windowsCommand(),
+		macroCommand(),
+		targetCommand(),
+		quarantineCommand(),
+		configCommand(),
+		snapshotCommand(),
+		benchCommand(),
+		relayCommand(),
+		infoCommand(),
+		promoteCommand(),
+		inventoryCommand(),
+		jobsCommand(),
+		jobCommand(),
+		collectCommand(),
+		approveCommand(),
+		keyCommand(),
 	}
 
 	app.Run(os.Args)
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// Run is a command resolved to the servers it will be executed on.
+type Run struct {
+	Environment string
+	Command     string
+	User        string
+	Servers     Servers
+	Skipped     Servers
+	// Approval identifies the approved run request the run comes from.
+	Approval string
+	// Script is run on the servers instead of Command, which is still what
+	// is shown and reported.
+	Script string
+}
+
+func (r Run) script() string {
+	if r.Script != "" {
+		return r.Script
+	}
+	return r.Command
+}
+
+func newRun(servers Servers, selector Selector, command string, user string) Run {
+	return Run{
+		Environment: selector.Environment,
+		Command:     command,
+		User:        user,
+		Servers:     filterServers(servers, selector),
+		Skipped:     skippedServers(servers, selector),
+	}
+}
+
+// runFlags are the flags of every command that runs a command on servers.
+func runFlags() []cli.Flag {
+	flags := []cli.Flag{
+		cli.IntFlag{
+			Name:  "parallel, p",
+			Value: 1,
+			Usage: "Run on up to `N` servers at the same time",
+		},
+		cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "Kill the command on a server after `DURATION` (exit code 124)",
+		},
+		cli.IntFlag{
+			Name:  "retries",
+			Usage: "Retry `N` times on servers that could not be reached (exit code 255)",
+		},
+		cli.IntFlag{
+			Name:  "max-failures",
+			Usage: "Stop starting new servers after `N` failures",
+		},
+		cli.StringFlag{
+			Name:  "record-mode",
+			Value: "merged",
+			Usage: "Record one file per host (per-host) or the combined output (merged)",
+		},
+	}
+	flags = append(flags, recordFlags()...)
+	flags = append(flags, lockFlags()...)
+	flags = append(flags, windowFlags()...)
+	return flags
+}
+
+func execFlags() []cli.Flag {
+	flags := append(runFlags(), cli.StringFlag{
+		Name:  "report",
+		Usage: "Write a run report to `FILE` (.html or .md)",
+	})
+	flags = append(flags, relayFlags()...)
+	flags = append(flags, detachFlags()...)
+	flags = append(flags, remoteDetachFlags()...)
+	flags = append(flags, requestFlags()...)
+	return flags
+}
+
+// runOnServer runs the command on one server, retrying while the server
+// cannot be reached.
+func runOnServer(server Server, run Run, record io.Writer, timeout time.Duration, retries int) Result {
+	start := time.Now()
+	result := Result{Server: server, Started: start}
+	for attempt := 0; ; attempt++ {
+		result.ExitCode, result.Stdout, result.Stderr = execCommand(server, run.User, run.script(), record, timeout)
+		if result.ExitCode != 255 || attempt >= retries {
+			break
+		}
+	}
+	result.Duration = time.Since(start)
+	return result
+}
+
+// runWorkers runs the command from up to parallel workers of this process.
+// No new server is started once stop reports true.
+func runWorkers(c *cli.Context, run Run, parallel int, perHost bool, stop func() bool, done func(index int, result Result)) {
+	var wg sync.WaitGroup
+	jobs := make(chan int)
+	for worker := 0; worker < parallel; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range jobs {
+				if stop() {
+					continue
+				}
+				server := run.Servers[index]
+				var record io.Writer
+				var recorder *Recorder
+				if perHost {
+					var err error
+					recorder, err = newRecorder(c.String("record-dir"), server.Name, "dcr exec "+run.Command, true)
+					if err != nil {
+						// not recorded means not run, the run locks are held
+						done(index, Result{Server: server, ExitCode: 255, Stderr: fmt.Sprintf("cannot record: %v", err), Started: time.Now()})
+						continue
+					}
+					record = recorder
+				}
+				result := runOnServer(server, run, record, c.Duration("timeout"), c.Int("retries"))
+				if recorder != nil {
+					recorder.Close()
+				}
+				done(index, result)
+			}
+		}()
+	}
+	for index := range run.Servers {
+		if stop() {
+			break
+		}
+		jobs <- index
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// onInterrupt stops the transports and calls cleanup when dcr is interrupted
+// or terminated, then exits. A closed stdout must not end a run half way,
+// its output is lost. The returned function stops watching.
+func onInterrupt(cleanup func(os.Signal)) func() {
+	signal.Ignore(syscall.SIGPIPE)
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		received, ok := <-interrupted
+		if !ok {
+			return
+		}
+		processGroups.kill(syscall.SIGTERM)
+		cleanup(received)
+		os.Exit(128 + int(received.(syscall.Signal)))
+	}()
+	return func() {
+		signal.Stop(interrupted)
+		close(interrupted)
+	}
+}
+
+func runExec(c *cli.Context, run Run) error {
+	_, err := executeRun(c, run)
+	return err
+}
+
+// executeRun runs the command and returns the number of servers it failed on.
+func executeRun(c *cli.Context, run Run) (int, error) {
+	if c.String("report") != "" {
+		if _, err := reportFormat(c.String("report")); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
+	if c.Bool("detach") && c.Bool("remote-detach") {
+		log.Fatalf("Error: use either --detach or --remote-detach")
+	}
+	if c.String("relay-by") != "" && c.String("record-mode") == "per-host" && c.Bool("record") {
+		log.Fatalf("Error: per-host recording is not supported with relays")
+	}
+	settings, err := getSettings(c.GlobalString("settings"))
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if settings.Environments[run.Environment].RequireApproval && run.Approval == "" {
+		log.Fatalf("Error: environment %s requires approval, write a run request with --request-approval and run it with 'dcr exec --approved FILE'", run.Environment)
+	}
+	// the window of a detached job was checked when it was started
+	job := currentJob()
+	if job == nil {
+		if err := checkWindow(settings, run.Environment, run.Command, c.Bool("emergency"), c.String("reason")); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
+	// a supervisor records in its job why it stopped
+	fatal := func(err error) {
+		if job != nil {
+			finishJob(job, 0, len(run.Servers), err)
+		}
+		log.Fatalf("Error: %v", err)
+	}
+	locks, err := runLockNames(c.String("lock-scope"), run.Environment, run.Servers)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if c.Bool("detach") && job == nil {
+		if err := checkLocks(c.GlobalString("lock-dir"), run.Environment, locks); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		if run.Approval != "" {
+			if err := useRunRequest(c.GlobalString("lock-dir"), run.Approval); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+		}
+		job, err := startJob(run)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		fmt.Printf("Started job %s\n", job.ID)
+		return 0, nil
+	}
+	// everything that can fail is set up before the locks are taken, from
+	// here on errors are returned so that the locks are released
+	output := io.Writer(os.Stdout)
+	perHost := c.Bool("record") && c.String("record-mode") == "per-host"
+	if perHost {
+		if err := os.MkdirAll(c.String("record-dir"), 0755); err != nil {
+			fatal(err)
+		}
+	}
+	if c.Bool("record") && !perHost {
+		recorder, err := newRecorder(c.String("record-dir"), run.Environment+"-exec", "dcr exec "+run.Command, true)
+		if err != nil {
+			fatal(err)
+		}
+		defer recorder.Close()
+		output = io.MultiWriter(os.Stdout, recorder)
+	}
+	held, err := acquireRunLocks(c.GlobalString("lock-dir"), run.Environment, locks, run.Command, c.Duration("lock-ttl"))
+	if err != nil {
+		fatal(err)
+	}
+	defer held.Release()
+	// release the locks when interrupted, or cancelled with 'dcr job cancel'
+	defer onInterrupt(func(received os.Signal) {
+		held.Release()
+		if job != nil {
+			finishJob(job, 0, 0, fmt.Errorf("stopped by %v", received))
+		}
+	})()
+	// the approval of a detached job was used when it was started
+	if run.Approval != "" && job == nil {
+		if err := useRunRequest(c.GlobalString("lock-dir"), run.Approval); err != nil {
+			return 0, cli.NewExitError(fmt.Sprintf("Error: %v", err), 1)
+		}
+	}
+	if c.Bool("remote-detach") {
+		remote := RemoteRun{
+			ID:          newJobID(),
+			Command:     run.Command,
+			User:        run.User,
+			Environment: run.Environment,
+			Started:     time.Now(),
+		}
+		for _, server := range run.Servers {
+			remote.Hosts = append(remote.Hosts, server.Name)
+		}
+		if err := writeRemoteRun(remote); err != nil {
+			if job != nil {
+				finishJob(job, 0, len(run.Servers), err)
+			}
+			return 0, cli.NewExitError(fmt.Sprintf("Error: %v", err), 1)
+		}
+		run.Script = remoteStartScript(remote.ID, run.Command)
+		// the locks are handed over to the remote run and released by
+		// 'dcr collect' once the command finished everywhere
+		defer func() {
+			remote.Locks = held.Keep()
+			remote.LockTTL = c.Duration("lock-ttl")
+			if err := writeRemoteRun(remote); err != nil {
+				log.Printf("Error: %v", err)
+			}
+			fmt.Printf("Started remote run %s, fetch the results with 'dcr collect %s'\n", remote.ID, remote.ID)
+		}()
+	}
+
+	parallel := c.Int("parallel")
+	if parallel < 1 {
+		parallel = 1
+	}
+	maxFailures := c.Int("max-failures")
+	started := time.Now()
+	results := make([]*Result, len(run.Servers))
+	failures := 0
+	var mutex sync.Mutex
+	stopped := func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return maxFailures > 0 && failures >= maxFailures
+	}
+	done := func(index int, result Result) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		results[index] = &result
+		if result.ExitCode != 0 {
+			failures++
+		}
+		recordContact(result.Server, Contact{Via: "exec", User: run.User, ExitCode: result.ExitCode})
+		if job != nil {
+			if err := writeJobResult(job.ID, result); err != nil {
+				fmt.Fprintf(output, "\nError: %v\n", err)
+			}
+		}
+		fmt.Fprintf(output, "\n%2s[%10s] STDOUT: %10s\n", colorizeExitCode(result.ExitCode), result.Server.Name, strings.Trim(result.Stdout, "\n"))
+		if result.Stderr != "" {
+			fmt.Fprintf(output, "STDERR: %s\n", strings.Trim(result.Stderr, "\n"))
+		}
+	}
+	if c.String("relay-by") != "" {
+		runRelays(c, run, stopped, done)
+	} else {
+		runWorkers(c, run, parallel, perHost, stopped, done)
+	}
+
+	var completed []Result
+	var notRun Servers
+	for index, result := range results {
+		if result == nil {
+			fmt.Fprintf(output, "\nNot run %s (%d failures reached)\n", run.Servers[index].Name, maxFailures)
+			notRun = append(notRun, run.Servers[index])
+			continue
+		}
+		completed = append(completed, *result)
+	}
+	for _, server := range run.Skipped {
+		fmt.Fprintf(output, "\nSkipped %s (%s)\n", server.Name, server.disabledReason())
+	}
+	fmt.Fprintln(output, "")
+	if c.String("report") != "" {
+		if err := writeReport(c.String("report"), newReport(run, completed, notRun, started)); err != nil {
+			if job != nil {
+				finishJob(job, failures, len(notRun), err)
+			}
+			return failures, cli.NewExitError(fmt.Sprintf("Error: %v", err), 1)
+		}
+	}
+	if job != nil {
+		finishJob(job, failures, len(notRun), nil)
+	}
+	if len(notRun) != 0 {
+		return failures, cli.NewExitError(fmt.Sprintf("Stopped after %d failures, %d servers not run", failures, len(notRun)), 1)
+	}
+	return failures, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// Contact is the last time dcr reached a server.
+type Contact struct {
+	Time     time.Time `json:"time"`
+	Via      string    `json:"via"`
+	User     string    `json:"user,omitempty"`
+	ExitCode int       `json:"exit_code"`
+}
+
+func contactFile(name string) string {
+	return dcrPath(filepath.Join("contacts", unsafeFileChars.ReplaceAllString(name, "_")+".json"))
+}
+
+func recordContact(server Server, contact Contact) {
+	// simulated runs never reached the server
+	if _, simulated := transport.(*simulateTransport); simulated {
+		return
+	}
+	contact.Time = time.Now()
+	raw, err := json.Marshal(contact)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(contactFile(server.Name)), 0755)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(contactFile(server.Name), raw, 0644)
+	}
+	if err != nil {
+		log.Printf("Warning: could not record contact with %s: %v", server.Name, err)
+	}
+}
+
+func readContact(name string) (Contact, error) {
+	var contact Contact
+	raw, err := ioutil.ReadFile(contactFile(name))
+	if err != nil {
+		return contact, err
+	}
+	err = json.Unmarshal(raw, &contact)
+	return contact, err
+}
+
+func infoCommand() cli.Command {
+	return cli.Command{
+		Name:      "info",
+		Usage:     "Show everything dcr knows about a server",
+		ArgsUsage: "NAME",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "user, u",
+				Usage: "Show the connection settings for this user",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			name := c.Args().First()
+			if name == "" {
+				log.Fatalf("Error: server name is required")
+			}
+			configFile := c.GlobalString("config")
+			raw, err := ioutil.ReadFile(configFile)
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			inventory, err := parseInventory(raw)
+			if err != nil {
+				log.Fatalf("Error: %s: %v", configFile, err)
+			}
+			var server *Server
+			for _, candidate := range getServers(configFile) {
+				if candidate.Name == name {
+					candidate := candidate
+					server = &candidate
+					break
+				}
+			}
+			if server == nil {
+				log.Fatalf("Error: no server %s in %s", name, configFile)
+			}
+			settings, err := getSettings(c.GlobalString("settings"))
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			environment := settings.Environments[server.Environment]
+
+			entry, err := json.MarshalIndent(server, "", "  ")
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			fmt.Printf("Source:      %s (version %d)\n", configFile, inventory.Version)
+			fmt.Println(string(entry))
+
+			fmt.Printf("\nEnvironment: %s (%s)\n", server.Environment, c.GlobalString("settings"))
+			if environment.User != "" {
+				fmt.Printf("  user:      %s\n", environment.User)
+			}
+			fmt.Printf("  window:    %s\n", describeWindow(server.Environment, environment, time.Now()))
+
+			remoteUser := defaultUser(c.GlobalString("settings"), server.Environment, c.String("user"))
+			fmt.Printf("\nConnection:\n")
+			transportName := c.GlobalString("transport")
+			if server.Transport != "" && transportName != "simulate" {
+				transportName = string(server.Transport)
+			}
+			fmt.Printf("  transport: %s\n", transportName)
+			if remoteUser != "" {
+				fmt.Printf("  user:      %s\n", remoteUser)
+			} else {
+				fmt.Printf("  user:      (transport default)\n")
+			}
+			var args []string
+			for _, arg := range transportCommand(*server, remoteUser, "").Args {
+				if arg == "" || strings.ContainsAny(arg, " \t\n'\"") {
+					arg = shellQuote(arg)
+				}
+				args = append(args, arg)
+			}
+			fmt.Printf("  command:   %s\n", strings.Join(args, " "))
+			var secrets []string
+			for secret, value := range server.secrets() {
+				if value.Encrypted() {
+					secret += " (encrypted)"
+				}
+				secrets = append(secrets, secret)
+			}
+			sort.Strings(secrets)
+			if len(secrets) != 0 {
+				fmt.Printf("  secrets:   %s\n", strings.Join(secrets, ", "))
+			}
+
+			fmt.Printf("\nState:\n")
+			if server.isDisabled() {
+				fmt.Printf("  %s\n", server.disabledReason())
+			} else {
+				fmt.Printf("  enabled\n")
+			}
+			if contact, err := readContact(server.Name); err == nil {
+				via := contact.Via
+				if contact.User != "" {
+					via += " as " + contact.User
+				}
+				fmt.Printf("  last contact: %s via %s (exit %d)\n", contact.Time.Format(time.RFC3339), via, contact.ExitCode)
+			} else {
+				fmt.Printf("  last contact: never\n")
+			}
+			locks, err := listLocks(c.GlobalString("lock-dir"))
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			for _, lock := range locks {
+				if lock.Name == "env-"+server.Environment || lock.Name == "server-"+server.Name {
+					fmt.Printf("  locked:    %s by %s since %s (command: %q)\n", lock.Name, lock.Owner, lock.Acquired.Format(time.RFC3339), lock.Command)
+				}
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// environmentLabel is the container or pod label that sets the environment
+// of a listed server. Servers without it get the --env environment.
+const environmentLabel = "environment"
+
+type dockerContainer struct {
+	Names  string
+	Labels string
+}
+
+type kubernetesPods struct {
+	Items []struct {
+		Metadata struct {
+			Name      string            `json:"name"`
+			Namespace string            `json:"namespace"`
+			Labels    map[string]string `json:"labels"`
+		} `json:"metadata"`
+		Status struct {
+			Phase string `json:"phase"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+func providerOutput(name string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+func providerServer(name string, environment string, labels Labels) Server {
+	if labels[environmentLabel] != "" {
+		environment = labels[environmentLabel]
+	}
+	if len(labels) == 0 {
+		labels = nil
+	}
+	return Server{Name: name, Environment: environment, Tags: Tags{}, Labels: labels}
+}
+
+// dockerServers lists the running containers.
+func dockerServers(environment string, filters []string) (Servers, error) {
+	args := []string{"ps", "--format", "{{json .}}"}
+	for _, filter := range filters {
+		args = append(args, "--filter", filter)
+	}
+	output, err := providerOutput("docker", args...)
+	if err != nil {
+		return nil, err
+	}
+	var servers Servers
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var container dockerContainer
+		if err := json.Unmarshal(scanner.Bytes(), &container); err != nil {
+			return nil, fmt.Errorf("docker ps: %v", err)
+		}
+		labels := Labels{}
+		for _, pair := range splitList(container.Labels) {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) == 2 {
+				labels[parts[0]] = parts[1]
+			}
+		}
+		name := strings.Split(container.Names, ",")[0]
+		server := providerServer(name, environment, labels)
+		server.Transport = "docker"
+		server.Container = name
+		servers = append(servers, server)
+	}
+	return servers, scanner.Err()
+}
+
+// kubectlServers lists the running pods.
+func kubectlServers(environment string, context string, namespace string, selector string, container string) (Servers, error) {
+	var args []string
+	if context != "" {
+		args = append(args, "--context", context)
+	}
+	args = append(args, "get", "pods", "-o", "json")
+	if namespace != "" {
+		args = append(args, "-n", namespace)
+	} else {
+		args = append(args, "--all-namespaces")
+	}
+	if selector != "" {
+		args = append(args, "-l", selector)
+	}
+	output, err := providerOutput("kubectl", args...)
+	if err != nil {
+		return nil, err
+	}
+	var pods kubernetesPods
+	if err := json.Unmarshal(output, &pods); err != nil {
+		return nil, fmt.Errorf("kubectl get pods: %v", err)
+	}
+	var servers Servers
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != "Running" {
+			continue
+		}
+		server := providerServer(pod.Metadata.Name, environment, pod.Metadata.Labels)
+		server.Transport = "kubectl"
+		server.Pod = pod.Metadata.Name
+		server.Namespace = pod.Metadata.Namespace
+		server.Context = context
+		server.Container = container
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+func printInventory(servers Servers) {
+	if servers == nil {
+		servers = Servers{}
+	}
+	raw, err := json.MarshalIndent(Inventory{Version: inventoryVersion, Servers: servers}, "", "  ")
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	fmt.Println(string(raw))
+}
+
+func inventoryCommand() cli.Command {
+	return cli.Command{
+		Name:  "inventory",
+		Usage: "Print servers found by a provider in the servers file format",
+		Subcommands: []cli.Command{
+			{
+				Name:  "docker",
+				Usage: "List running docker containers",
+				Flags: []cli.Flag{
+					cli.StringSliceFlag{
+						Name:  "filter",
+						Usage: "Only list containers matching the docker ps `FILTER`",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					servers, err := dockerServers(c.GlobalString("env"), c.StringSlice("filter"))
+					if err != nil {
+						log.Fatalf("Error: %v", err)
+					}
+					printInventory(servers)
+					return nil
+				},
+			},
+			{
+				Name:  "kubectl",
+				Usage: "List running Kubernetes pods",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "context",
+						Usage: "kubeconfig `CONTEXT` to use",
+					},
+					cli.StringFlag{
+						Name:  "namespace, n",
+						Usage: "Only list pods in `NAMESPACE`",
+					},
+					cli.StringFlag{
+						Name:  "selector, l",
+						Usage: "Only list pods matching the label `SELECTOR`",
+					},
+					cli.StringFlag{
+						Name:  "container",
+						Usage: "Run commands in `CONTAINER` of each pod",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					servers, err := kubectlServers(c.GlobalString("env"), c.String("context"), c.String("namespace"), c.String("selector"), c.String("container"))
+					if err != nil {
+						log.Fatalf("Error: %v", err)
+					}
+					printInventory(servers)
+					return nil
+				},
+			},
+			importCommand(),
+		},
+	}
+}
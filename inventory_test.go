@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeCommand puts a shell script named name on PATH. The script records its
+// arguments in name.args and prints output.
+func fakeCommand(t *testing.T, name string, output string) string {
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, name+".args")
+	script := "#!/bin/sh\nprintf '%s\\n' \"$@\" > " + shellQuote(argsFile) + "\ncat <<'EOF'\n" + output + "\nEOF\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return argsFile
+}
+
+func readArgs(t *testing.T, file string) []string {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(raw), "\n"), "\n")
+}
+
+func TestDockerServers(t *testing.T) {
+	argsFile := fakeCommand(t, "docker", `{"Names":"web-1,web","Labels":"environment=prod,role=web"}
+{"Names":"cache","Labels":""}`)
+	servers, err := dockerServers("dev", []string{"label=role"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Servers{
+		{Name: "web-1", Environment: "prod", Tags: Tags{}, Labels: Labels{"environment": "prod", "role": "web"}, Transport: "docker", Container: "web-1"},
+		{Name: "cache", Environment: "dev", Tags: Tags{}, Transport: "docker", Container: "cache"},
+	}
+	if !reflect.DeepEqual(servers, want) {
+		t.Errorf("dockerServers = %+v, want %+v", servers, want)
+	}
+	args := readArgs(t, argsFile)
+	if want := []string{"ps", "--format", "{{json .}}", "--filter", "label=role"}; !reflect.DeepEqual(args, want) {
+		t.Errorf("docker called with %q, want %q", args, want)
+	}
+}
+
+func TestKubectlServers(t *testing.T) {
+	argsFile := fakeCommand(t, "kubectl", `{"items": [
+  {"metadata": {"name": "api-1", "namespace": "shop", "labels": {"app": "api"}}, "status": {"phase": "Running"}},
+  {"metadata": {"name": "api-2", "namespace": "shop"}, "status": {"phase": "Pending"}}
+]}`)
+	servers, err := kubectlServers("prod", "cluster", "shop", "app=api", "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Servers{
+		{Name: "api-1", Environment: "prod", Tags: Tags{}, Labels: Labels{"app": "api"}, Transport: "kubectl", Pod: "api-1", Namespace: "shop", Context: "cluster", Container: "main"},
+	}
+	if !reflect.DeepEqual(servers, want) {
+		t.Errorf("kubectlServers = %+v, want %+v", servers, want)
+	}
+	args := readArgs(t, argsFile)
+	if want := []string{"--context", "cluster", "get", "pods", "-o", "json", "-n", "shop", "-l", "app=api"}; !reflect.DeepEqual(args, want) {
+		t.Errorf("kubectl called with %q, want %q", args, want)
+	}
+}
+
+func TestProviderError(t *testing.T) {
+	dir := t.TempDir()
+	script := "#!/bin/sh\necho 'cannot connect to the daemon' >&2\nexit 1\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "docker"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	if _, err := dockerServers("dev", nil); err == nil || !strings.Contains(err.Error(), "cannot connect to the daemon") {
+		t.Errorf("dockerServers error = %v, want the docker error output", err)
+	}
+}
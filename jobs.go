@@ -0,0 +1,336 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// jobEnv tells a dcr process that it is the supervisor of a detached job.
+const jobEnv = "DCR_JOB"
+
+// Job is a detached exec run. Its state is kept in the job directory, so it
+// outlives the dcr process that started it.
+type Job struct {
+	ID          string     `json:"id"`
+	Command     string     `json:"command"`
+	User        string     `json:"user,omitempty"`
+	Environment string     `json:"environment"`
+	Hosts       []string   `json:"hosts"`
+	Pid         int        `json:"pid,omitempty"`
+	State       string     `json:"state"`
+	Started     time.Time  `json:"started"`
+	Finished    *time.Time `json:"finished,omitempty"`
+	Failed      int        `json:"failed"`
+	NotRun      int        `json:"not_run"`
+	Error       string     `json:"error,omitempty"`
+}
+
+func jobDir(id string) string {
+	return dcrPath(filepath.Join("jobs", unsafeFileChars.ReplaceAllString(id, "_")))
+}
+
+func jobHostFile(id string, host string) string {
+	return filepath.Join(jobDir(id), "hosts", unsafeFileChars.ReplaceAllString(host, "_")+".json")
+}
+
+func readJob(id string) (Job, error) {
+	var job Job
+	raw, err := ioutil.ReadFile(filepath.Join(jobDir(id), "job.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return job, fmt.Errorf("no job %s", id)
+		}
+		return job, err
+	}
+	err = json.Unmarshal(raw, &job)
+	return job, err
+}
+
+func writeJob(job Job) error {
+	raw, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(jobDir(job.ID), "job.json")
+	if err := ioutil.WriteFile(file+".tmp", raw, 0644); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+func readJobResult(id string, host string) (HostResult, error) {
+	var result HostResult
+	raw, err := ioutil.ReadFile(jobHostFile(id, host))
+	if err != nil {
+		return result, err
+	}
+	err = json.Unmarshal(raw, &result)
+	return result, err
+}
+
+func writeJobResult(id string, result Result) error {
+	raw, err := json.MarshalIndent(hostResult(result), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(jobHostFile(id, result.Server.Name), raw, 0644)
+}
+
+// jobState is the state of the job, or "lost" when its supervisor died
+// without recording the end of the run.
+func jobState(job Job) string {
+	if job.State == "running" && job.Pid != 0 && syscall.Kill(job.Pid, 0) != nil {
+		return "lost"
+	}
+	return job.State
+}
+
+func newJobID() string {
+	random := make([]byte, 3)
+	rand.Read(random)
+	return time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(random)
+}
+
+// detachedArgs are the arguments this dcr was started with, without the
+// flag that asked to detach.
+func detachedArgs() []string {
+	var args []string
+	for _, arg := range os.Args[1:] {
+		switch arg {
+		case "--detach", "-detach", "--detach=true", "-detach=true":
+			continue
+		}
+		args = append(args, arg)
+	}
+	return args
+}
+
+// startJob runs this dcr again as a supervisor in a session of its own, with
+// its output going to the job directory.
+func startJob(run Run) (Job, error) {
+	job := Job{
+		ID:          newJobID(),
+		Command:     run.Command,
+		User:        run.User,
+		Environment: run.Environment,
+		State:       "running",
+		Started:     time.Now(),
+	}
+	for _, server := range run.Servers {
+		job.Hosts = append(job.Hosts, server.Name)
+	}
+	if err := os.MkdirAll(filepath.Join(jobDir(job.ID), "hosts"), 0755); err != nil {
+		return job, err
+	}
+	if err := writeJob(job); err != nil {
+		return job, err
+	}
+	logFile, err := os.Create(filepath.Join(jobDir(job.ID), "output.log"))
+	if err != nil {
+		return job, err
+	}
+	defer logFile.Close()
+	cmd := exec.Command(os.Args[0], detachedArgs()...)
+	cmd.Env = append(os.Environ(), jobEnv+"="+job.ID)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return job, err
+	}
+	return job, cmd.Process.Release()
+}
+
+// currentJob returns the job this process supervises, if any.
+func currentJob() *Job {
+	id := os.Getenv(jobEnv)
+	if id == "" {
+		return nil
+	}
+	job, err := readJob(id)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if job.State != "running" {
+		log.Fatalf("Error: job %s is %s", job.ID, job.State)
+	}
+	job.Pid = os.Getpid()
+	if err := writeJob(job); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	return &job
+}
+
+// finishJob records the end of the run, and err when the supervisor stopped
+// before it was complete.
+func finishJob(job *Job, failed int, notRun int, err error) {
+	latest, readErr := readJob(job.ID)
+	if readErr != nil || latest.State != "running" {
+		return
+	}
+	finished := time.Now()
+	latest.Finished = &finished
+	latest.Failed = failed
+	latest.NotRun = notRun
+	latest.State = "done"
+	if failed != 0 || notRun != 0 || err != nil {
+		latest.State = "failed"
+	}
+	if err != nil {
+		latest.Error = err.Error()
+	}
+	if writeErr := writeJob(latest); writeErr != nil {
+		log.Printf("Error: %v", writeErr)
+	}
+}
+
+func listJobs() []Job {
+	dirs, _ := filepath.Glob(dcrPath(filepath.Join("jobs", "*")))
+	var jobs []Job
+	for _, dir := range dirs {
+		job, err := readJob(filepath.Base(dir))
+		if err == nil {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Started.After(jobs[j].Started) })
+	return jobs
+}
+
+func detachFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.BoolFlag{
+			Name:  "detach",
+			Usage: "Run in the background and print the job ID, see 'dcr jobs'",
+		},
+	}
+}
+
+func jobsCommand() cli.Command {
+	return cli.Command{
+		Name:  "jobs",
+		Usage: "List detached jobs",
+		Action: func(c *cli.Context) error {
+			for _, job := range listJobs() {
+				fmt.Printf("%s %-8s %s %d hosts %q\n", job.ID, jobState(job), job.Environment, len(job.Hosts), job.Command)
+			}
+			return nil
+		},
+	}
+}
+
+func jobCommand() cli.Command {
+	return cli.Command{
+		Name:  "job",
+		Usage: "Show and manage a detached job",
+		Subcommands: []cli.Command{
+			{
+				Name:      "status",
+				Usage:     "Show the state of a job and its hosts",
+				ArgsUsage: "ID",
+				Action: func(c *cli.Context) error {
+					job, err := readJob(c.Args().First())
+					if err != nil {
+						log.Fatalf("Error: %v", err)
+					}
+					fmt.Printf("Job:         %s\n", job.ID)
+					fmt.Printf("State:       %s\n", jobState(job))
+					fmt.Printf("Command:     %s\n", job.Command)
+					fmt.Printf("Environment: %s\n", job.Environment)
+					fmt.Printf("Started:     %s\n", job.Started.Format(time.RFC3339))
+					if job.Finished != nil {
+						fmt.Printf("Finished:    %s\n", job.Finished.Format(time.RFC3339))
+					}
+					if job.Error != "" {
+						fmt.Printf("Error:       %s\n", job.Error)
+					}
+					fmt.Println()
+					for _, host := range job.Hosts {
+						result, err := readJobResult(job.ID, host)
+						if err != nil {
+							fmt.Printf("%-20s pending\n", host)
+							continue
+						}
+						fmt.Printf("%-20s exit %-3d %s\n", host, result.ExitCode, result.Duration)
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "logs",
+				Usage:     "Print the output of a job",
+				ArgsUsage: "ID",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "host",
+						Usage: "Only print the output of `HOST`",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					job, err := readJob(c.Args().First())
+					if err != nil {
+						log.Fatalf("Error: %v", err)
+					}
+					if c.String("host") == "" {
+						raw, err := ioutil.ReadFile(filepath.Join(jobDir(job.ID), "output.log"))
+						if err != nil {
+							log.Fatalf("Error: %v", err)
+						}
+						os.Stdout.Write(raw)
+						return nil
+					}
+					result, err := readJobResult(job.ID, c.String("host"))
+					if err != nil {
+						log.Fatalf("Error: no result for %s in job %s yet", c.String("host"), job.ID)
+					}
+					fmt.Println(strings.TrimRight(result.Stdout, "\n"))
+					if result.Stderr != "" {
+						fmt.Fprintln(os.Stderr, strings.TrimRight(result.Stderr, "\n"))
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "cancel",
+				Usage:     "Stop a running job",
+				ArgsUsage: "ID",
+				Action: func(c *cli.Context) error {
+					job, err := readJob(c.Args().First())
+					if err != nil {
+						log.Fatalf("Error: %v", err)
+					}
+					if jobState(job) != "running" {
+						log.Fatalf("Error: job %s is %s", job.ID, jobState(job))
+					}
+					if job.Pid != 0 {
+						// signal the whole process group the supervisor leads
+						if err := syscall.Kill(-job.Pid, syscall.SIGTERM); err != nil {
+							log.Fatalf("Error: %v", err)
+						}
+					}
+					finished := time.Now()
+					job.Finished = &finished
+					job.State = "cancelled"
+					if err := writeJob(job); err != nil {
+						log.Fatalf("Error: %v", err)
+					}
+					fmt.Printf("Cancelled job %s\n", job.ID)
+					return nil
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Labels map[string]string
+
+// LabelRequirement is one term of a Kubernetes-style label selector such as
+// role=web, tier!=backend, version in (2.3,2.4), legacy or !legacy.
+type LabelRequirement struct {
+	Key      string
+	Operator string
+	Values   []string
+}
+
+func splitLabelSelector(selector string) []string {
+	var terms []string
+	depth := 0
+	start := 0
+	for index, r := range selector {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				terms = append(terms, selector[start:index])
+				start = index + 1
+			}
+		}
+	}
+	return append(terms, selector[start:])
+}
+
+func parseSetValues(values string) ([]string, error) {
+	values = strings.TrimSpace(values)
+	if !strings.HasPrefix(values, "(") || !strings.HasSuffix(values, ")") {
+		return nil, fmt.Errorf("expected (value,...) but got %q", values)
+	}
+	return splitList(values[1 : len(values)-1]), nil
+}
+
+func parseLabelRequirement(term string) (LabelRequirement, error) {
+	term = strings.TrimSpace(term)
+	fields := strings.Fields(term)
+	if len(fields) >= 2 && (fields[1] == "in" || fields[1] == "notin") {
+		rest := strings.TrimSpace(strings.TrimPrefix(term, fields[0]))
+		values, err := parseSetValues(strings.TrimPrefix(rest, fields[1]))
+		if err != nil {
+			return LabelRequirement{}, err
+		}
+		return LabelRequirement{Key: fields[0], Operator: fields[1], Values: values}, nil
+	}
+	for _, operator := range []string{"!=", "==", "="} {
+		if index := strings.Index(term, operator); index > 0 {
+			value := strings.TrimSpace(term[index+len(operator):])
+			key := strings.TrimSpace(term[:index])
+			if operator == "==" {
+				operator = "="
+			}
+			return LabelRequirement{Key: key, Operator: operator, Values: []string{value}}, nil
+		}
+	}
+	if strings.HasPrefix(term, "!") && len(term) > 1 {
+		return LabelRequirement{Key: strings.TrimSpace(term[1:]), Operator: "!"}, nil
+	}
+	if term == "" || strings.ContainsAny(term, " ()=!") {
+		return LabelRequirement{}, fmt.Errorf("invalid label selector term %q", term)
+	}
+	return LabelRequirement{Key: term, Operator: "exists"}, nil
+}
+
+func parseLabelSelector(selector string) ([]LabelRequirement, error) {
+	var requirements []LabelRequirement
+	if strings.TrimSpace(selector) == "" {
+		return requirements, nil
+	}
+	for _, term := range splitLabelSelector(selector) {
+		requirement, err := parseLabelRequirement(term)
+		if err != nil {
+			return nil, err
+		}
+		requirements = append(requirements, requirement)
+	}
+	return requirements, nil
+}
+
+func (r LabelRequirement) matches(labels Labels) bool {
+	value, ok := labels[r.Key]
+	switch r.Operator {
+	case "=":
+		return ok && value == r.Values[0]
+	case "!=":
+		return !ok || value != r.Values[0]
+	case "in":
+		return ok && contains(r.Values, value)
+	case "notin":
+		return !ok || !contains(r.Values, value)
+	case "!":
+		return !ok
+	default:
+		return ok
+	}
+}
+
+func filterByLabels(servers Servers, requirements []LabelRequirement) Servers {
+	var filtered Servers
+	for _, server := range servers {
+		matches := true
+		for _, requirement := range requirements {
+			if !requirement.matches(server.Labels) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			filtered = append(filtered, server)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLabelSelector(t *testing.T) {
+	tests := []struct {
+		selector     string
+		requirements []LabelRequirement
+	}{
+		{"", nil},
+		{"role=web", []LabelRequirement{{Key: "role", Operator: "=", Values: []string{"web"}}}},
+		{"role == web", []LabelRequirement{{Key: "role", Operator: "=", Values: []string{"web"}}}},
+		{"tier!=backend", []LabelRequirement{{Key: "tier", Operator: "!=", Values: []string{"backend"}}}},
+		{"version in (2.3, 2.4)", []LabelRequirement{{Key: "version", Operator: "in", Values: []string{"2.3", "2.4"}}}},
+		{"legacy,!canary", []LabelRequirement{{Key: "legacy", Operator: "exists"}, {Key: "canary", Operator: "!"}}},
+		{
+			"role=web,zone notin (a,b),legacy",
+			[]LabelRequirement{
+				{Key: "role", Operator: "=", Values: []string{"web"}},
+				{Key: "zone", Operator: "notin", Values: []string{"a", "b"}},
+				{Key: "legacy", Operator: "exists"},
+			},
+		},
+	}
+	for _, test := range tests {
+		requirements, err := parseLabelSelector(test.selector)
+		if err != nil {
+			t.Errorf("parseLabelSelector(%q): %v", test.selector, err)
+			continue
+		}
+		if !reflect.DeepEqual(requirements, test.requirements) {
+			t.Errorf("parseLabelSelector(%q) = %+v, want %+v", test.selector, requirements, test.requirements)
+		}
+	}
+}
+
+func TestParseLabelSelectorErrors(t *testing.T) {
+	for _, selector := range []string{"a b", "version in 2.3", "zone notin (a", "role=web,", "(a)"} {
+		if requirements, err := parseLabelSelector(selector); err == nil {
+			t.Errorf("parseLabelSelector(%q) = %+v, want an error", selector, requirements)
+		}
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+type Lock struct {
+	Name        string    `json:"name"`
+	Token       string    `json:"token,omitempty"`
+	Environment string    `json:"environment,omitempty"`
+	Owner       string    `json:"owner"`
+	Command     string    `json:"command"`
+	Acquired    time.Time `json:"acquired"`
+	Expires     time.Time `json:"expires"`
+}
+
+type LockedError struct {
+	Lock Lock
+}
+
+func (e LockedError) Error() string {
+	return fmt.Sprintf("%s is locked by %s since %s (command: %q, expires %s)",
+		e.Lock.Name, e.Lock.Owner, e.Lock.Acquired.Format(time.RFC3339), e.Lock.Command, e.Lock.Expires.Format(time.RFC3339))
+}
+
+func lockFile(dir string, name string) string {
+	return filepath.Join(dir, unsafeFileChars.ReplaceAllString(name, "_")+".lock")
+}
+
+func readLock(file string) (Lock, error) {
+	var lock Lock
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return lock, err
+	}
+	err = json.Unmarshal(raw, &lock)
+	return lock, err
+}
+
+// acquireLock creates the lock file exclusively, so it is safe to use on a
+// directory shared between machines. An expired lock is taken over.
+func acquireLock(dir string, lock Lock) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	raw, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := lockFile(dir, lock.Name)
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = f.Write(raw)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			return err
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		existing, err := readLock(file)
+		if err != nil {
+			return err
+		}
+		if time.Now().Before(existing.Expires) {
+			return LockedError{Lock: existing}
+		}
+		if err := removeStaleLock(file, existing); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("could not acquire lock %s", lock.Name)
+}
+
+// removeStaleLock removes the expired lock that was read from file. Another
+// process may have taken it over since, so the file is first moved aside and
+// put back if it turns out to be a new lock.
+func removeStaleLock(file string, stale Lock) error {
+	aside := file + ".stale-" + newLockToken()
+	if err := os.Rename(file, aside); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	moved, err := readLock(aside)
+	if err != nil || moved.Token != stale.Token {
+		// os.Link does not replace a lock created in the meantime
+		if err := os.Link(aside, file); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	return os.Remove(aside)
+}
+
+// conflictingLock returns a lock of another run that conflicts with the
+// locks names on the environment. Besides the same locks, the environment
+// lock conflicts with the server locks taken on its servers, and the other
+// way round. Locks with a token in own are ignored.
+func conflictingLock(dir string, environment string, names []string, own map[string]bool) (*Lock, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	locks, err := listLocks(dir)
+	if err != nil {
+		return nil, err
+	}
+	envLock := "env-" + environment
+	wholeEnvironment := contains(names, envLock)
+	for _, lock := range locks {
+		if own[lock.Token] || !time.Now().Before(lock.Expires) {
+			continue
+		}
+		if contains(names, lock.Name) ||
+			(wholeEnvironment && lock.Environment == environment) ||
+			(!wholeEnvironment && lock.Name == envLock) {
+			lock := lock
+			return &lock, nil
+		}
+	}
+	return nil, nil
+}
+
+// checkLocks fails when the locks could not be taken, without taking them.
+func checkLocks(dir string, environment string, names []string) error {
+	lock, err := conflictingLock(dir, environment, names, nil)
+	if err != nil {
+		return err
+	}
+	if lock != nil {
+		return LockedError{Lock: *lock}
+	}
+	return nil
+}
+
+func releaseLock(dir string, name string) error {
+	return os.Remove(lockFile(dir, name))
+}
+
+func listLocks(dir string) ([]Lock, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.lock"))
+	if err != nil {
+		return nil, err
+	}
+	var locks []Lock
+	for _, file := range files {
+		lock, err := readLock(file)
+		if err != nil {
+			continue
+		}
+		locks = append(locks, lock)
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Name < locks[j].Name })
+	return locks, nil
+}
+
+// runLockNames returns the locks an exec has to hold: one for the
+// environment, or one per server so that overlapping server sets conflict.
+func runLockNames(scope string, environment string, servers Servers) ([]string, error) {
+	switch scope {
+	case "none":
+		return nil, nil
+	case "servers":
+		var names []string
+		for _, server := range servers {
+			names = append(names, "server-"+server.Name)
+		}
+		return names, nil
+	case "env":
+		return []string{"env-" + environment}, nil
+	default:
+		return nil, fmt.Errorf("unknown lock scope %q, use env, servers or none", scope)
+	}
+}
+
+// RunLocks are the locks held by a run. They are renewed while the run is
+// active, so a run longer than the lock TTL keeps them.
+type RunLocks struct {
+	dir   string
+	ttl   time.Duration
+	locks []Lock
+	mutex sync.Mutex
+	stop  chan struct{}
+	once  sync.Once
+}
+
+func newLockToken() string {
+	token := make([]byte, 16)
+	rand.Read(token)
+	return hex.EncodeToString(token)
+}
+
+// acquireRunLocks takes the locks, then checks for conflicting locks of other
+// runs. Two runs that take conflicting locks at the same time see each
+// other's locks, so at most one of them proceeds.
+func acquireRunLocks(dir string, environment string, names []string, command string, ttl time.Duration) (*RunLocks, error) {
+	held := &RunLocks{dir: dir, ttl: ttl, stop: make(chan struct{})}
+	now := time.Now()
+	own := map[string]bool{}
+	for _, name := range names {
+		lock := Lock{
+			Name:        name,
+			Token:       newLockToken(),
+			Environment: environment,
+			Owner:       currentOwner(),
+			Command:     command,
+			Acquired:    now,
+			Expires:     now.Add(ttl),
+		}
+		if err := acquireLock(dir, lock); err != nil {
+			held.Release()
+			return nil, err
+		}
+		held.locks = append(held.locks, lock)
+		own[lock.Token] = true
+	}
+	conflict, err := conflictingLock(dir, environment, names, own)
+	if err != nil || conflict != nil {
+		held.Release()
+		if err != nil {
+			return nil, err
+		}
+		return nil, LockedError{Lock: *conflict}
+	}
+	go held.renew()
+	return held, nil
+}
+
+func (l *RunLocks) renew() {
+	interval := l.ttl / 3
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+		l.mutex.Lock()
+		var renewed []Lock
+		for _, lock := range l.locks {
+			lock.Expires = time.Now().Add(l.ttl)
+			if lost, err := renewLock(l.dir, lock); lost {
+				// a lost lock is not ours to renew or release any more
+				log.Printf("Warning: lost lock %s: %v", lock.Name, err)
+				continue
+			} else if err != nil {
+				log.Printf("Warning: could not renew lock %s: %v", lock.Name, err)
+			}
+			renewed = append(renewed, lock)
+		}
+		l.locks = renewed
+		l.mutex.Unlock()
+	}
+}
+
+// Keep stops renewing the locks and returns them without removing them, for
+// whoever takes them over.
+func (l *RunLocks) Keep() []Lock {
+	l.once.Do(func() { close(l.stop) })
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	kept := l.locks
+	l.locks = nil
+	return kept
+}
+
+// Release stops renewing the locks and removes those that are still ours.
+func (l *RunLocks) Release() {
+	l.once.Do(func() { close(l.stop) })
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, lock := range l.locks {
+		if err := releaseOwnLock(l.dir, lock); err != nil {
+			log.Printf("Warning: could not release lock %s: %v", lock.Name, err)
+		}
+	}
+	l.locks = nil
+}
+
+// renewLock extends a lock that is still ours, and reports whether it was
+// lost. The file is replaced in one rename, so readers never see it half
+// written.
+func renewLock(dir string, lock Lock) (bool, error) {
+	file := lockFile(dir, lock.Name)
+	existing, err := readLock(file)
+	if os.IsNotExist(err) {
+		return true, errors.New("removed")
+	}
+	if err != nil {
+		return false, err
+	}
+	if existing.Token != lock.Token {
+		return true, fmt.Errorf("taken over by %s", existing.Owner)
+	}
+	raw, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	if err := ioutil.WriteFile(file+"."+lock.Token, raw, 0644); err != nil {
+		return false, err
+	}
+	return false, os.Rename(file+"."+lock.Token, file)
+}
+
+// releaseOwnLock removes a lock unless it was broken and taken by someone
+// else in the meantime.
+func releaseOwnLock(dir string, lock Lock) error {
+	file := lockFile(dir, lock.Name)
+	existing, err := readLock(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if existing.Token != lock.Token {
+		return fmt.Errorf("taken over by %s, leaving it", existing.Owner)
+	}
+	return releaseLock(dir, lock.Name)
+}
+
+func lockFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "lock-scope",
+			Value: "env",
+			Usage: "Lock the whole environment (env), each selected server (servers) or nothing (none)",
+		},
+		cli.DurationFlag{
+			Name:  "lock-ttl",
+			Value: time.Hour,
+			Usage: "Consider the lock stale after `DURATION`",
+		},
+	}
+}
+
+func lockCommand() cli.Command {
+	return cli.Command{
+		Name:  "lock",
+		Usage: "Manage run locks",
+		Subcommands: []cli.Command{
+			{
+				Name:    "list",
+				Aliases: []string{"ls"},
+				Usage:   "List held locks",
+				Action: func(c *cli.Context) error {
+					locks, err := listLocks(c.GlobalString("lock-dir"))
+					if err != nil {
+						log.Fatalf("Error: %v", err)
+					}
+					for _, lock := range locks {
+						state := "held"
+						if time.Now().After(lock.Expires) {
+							state = "expired"
+						}
+						fmt.Printf("%s %s %s %s %s %q\n", lock.Name, state, lock.Owner,
+							lock.Acquired.Format(time.RFC3339), lock.Expires.Format(time.RFC3339), lock.Command)
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "break",
+				Usage:     "Remove a lock held by someone else",
+				ArgsUsage: "NAME...",
+				Action: func(c *cli.Context) error {
+					if c.NArg() == 0 {
+						log.Fatalf("Error: lock name is required")
+					}
+					for _, name := range c.Args() {
+						name = strings.TrimSuffix(name, ".lock")
+						lock, err := readLock(lockFile(c.GlobalString("lock-dir"), name))
+						if err != nil {
+							log.Fatalf("Error: %v", err)
+						}
+						if err := releaseLock(c.GlobalString("lock-dir"), name); err != nil {
+							log.Fatalf("Error: %v", err)
+						}
+						fmt.Printf("Broke lock %s held by %s since %s\n", name, lock.Owner, lock.Acquired.Format(time.RFC3339))
+					}
+					return nil
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/urfave/cli"
+)
+
+// Macro is a named command from the settings file. Cmd is a text/template
+// filled in with the key=value parameters given to 'dcr run'.
+type Macro struct {
+	Cmd         string   `json:"cmd"`
+	Description string   `json:"description,omitempty"`
+	User        string   `json:"user,omitempty"`
+	Environment string   `json:"env,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+}
+
+func parseParams(args []string) (map[string]string, error) {
+	params := map[string]string{}
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid parameter %q, expected key=value", arg)
+		}
+		params[parts[0]] = parts[1]
+	}
+	return params, nil
+}
+
+func (m Macro) expand(params map[string]string) (string, error) {
+	tmpl, err := template.New("cmd").Option("missingkey=error").Parse(m.Cmd)
+	if err != nil {
+		return "", err
+	}
+	var buffer bytes.Buffer
+	if err := tmpl.Execute(&buffer, params); err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
+
+func listMacros(macros map[string]Macro) {
+	var names []string
+	for name := range macros {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		macro := macros[name]
+		description := macro.Description
+		if description == "" {
+			description = macro.Cmd
+		}
+		fmt.Printf("%s %s\n", name, description)
+	}
+}
+
+func macroCommand() cli.Command {
+	return cli.Command{
+		Name:      "run",
+		Usage:     "Execute a command defined in the settings file",
+		ArgsUsage: "NAME [key=value...]",
+		Flags: append([]cli.Flag{
+			cli.StringFlag{
+				Name:  "user, u",
+				Usage: "User to run as, instead of the command's default",
+			},
+		}, execFlags()...),
+		Action: func(c *cli.Context) error {
+			settings, err := getSettings(c.GlobalString("settings"))
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			if c.NArg() == 0 {
+				listMacros(settings.Commands)
+				return nil
+			}
+			name := c.Args().First()
+			macro, ok := settings.Commands[name]
+			if !ok {
+				log.Fatalf("Error: unknown command %s", name)
+			}
+			params, err := parseParams(c.Args().Tail())
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			cmd, err := macro.expand(params)
+			if err != nil {
+				log.Fatalf("Error: %s: %v", name, err)
+			}
+
+			selector := globalSelector(c)
+			if selector.Environment == "" {
+				selector.Environment = macro.Environment
+			}
+			if selector.Environment == "" {
+				log.Fatalf("Error: environment flag is required for run")
+			}
+			if c.GlobalString("tags") == "" {
+				selector.Tags = macro.Tags
+			}
+			user := c.String("user")
+			if user == "" {
+				user = macro.User
+			}
+			user = defaultUser(c.GlobalString("settings"), selector.Environment, user)
+
+			servers := getServers(c.GlobalString("config"))
+			return requestOrExec(c, newRun(servers, selector, cmd, user), selector)
+		},
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+func promoteCommand() cli.Command {
+	return cli.Command{
+		Name:      "promote",
+		Usage:     "Run a command on one environment after the other, stopping at the first failure",
+		ArgsUsage: "COMMAND",
+		Flags: append([]cli.Flag{
+			cli.StringFlag{
+				Name:  "through",
+				Usage: "Comma separated `ENVIRONMENTS` to run on, in order",
+			},
+			cli.DurationFlag{
+				Name:  "soak",
+				Usage: "Wait `DURATION` after an environment passed before moving on",
+			},
+			cli.BoolFlag{
+				Name:  "yes, y",
+				Usage: "Move on to the next environment without asking",
+			},
+			cli.StringFlag{
+				Name:  "user, u",
+				Usage: "User to run as",
+			},
+		}, runFlags()...),
+		Action: func(c *cli.Context) error {
+			command := c.Args().First()
+			if command == "" {
+				log.Fatalf("Error: command is required for promote")
+			}
+			environments := splitList(c.String("through"))
+			if len(environments) == 0 {
+				log.Fatalf("Error: --through is required for promote")
+			}
+			if c.GlobalString("env") != "" {
+				log.Fatalf("Error: use --through instead of --env with promote")
+			}
+			servers := getServers(c.GlobalString("config"))
+
+			for index, environment := range environments {
+				if index > 0 {
+					if c.Duration("soak") > 0 {
+						fmt.Printf("Soaking %s for %s\n", environments[index-1], c.Duration("soak"))
+						time.Sleep(c.Duration("soak"))
+					}
+					if !c.Bool("yes") && !confirm(fmt.Sprintf("%s passed, promote to %s?", environments[index-1], environment)) {
+						return cli.NewExitError(fmt.Sprintf("Stopped before %s", environment), 1)
+					}
+				}
+				selector := globalSelector(c)
+				selector.Environment = environment
+				user := defaultUser(c.GlobalString("settings"), environment, c.String("user"))
+				run := newRun(servers, selector, command, user)
+				if len(run.Servers) == 0 {
+					return cli.NewExitError(fmt.Sprintf("Stopped at %s: no servers selected", environment), 1)
+				}
+				fmt.Printf("=== %s (%d servers)\n", environment, len(run.Servers))
+				failed, err := executeRun(c, run)
+				if err != nil {
+					return cli.NewExitError(fmt.Sprintf("Stopped at %s: %v", environment, err), 1)
+				}
+				if failed != 0 {
+					return cli.NewExitError(fmt.Sprintf("Stopped at %s: %d of %d servers failed", environment, failed, len(run.Servers)), 1)
+				}
+			}
+			fmt.Printf("Promoted through %s\n", c.String("through"))
+			return nil
+		},
+	}
+}
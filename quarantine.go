@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+type Quarantine struct {
+	Reason string    `json:"reason"`
+	Owner  string    `json:"owner"`
+	Added  time.Time `json:"added"`
+	Until  time.Time `json:"until"`
+}
+
+func quarantineFile() string {
+	return dcrPath("quarantine.json")
+}
+
+// getQuarantine returns the quarantined hosts that have not expired yet.
+func getQuarantine() (map[string]Quarantine, error) {
+	quarantine := map[string]Quarantine{}
+	raw, err := ioutil.ReadFile(quarantineFile())
+	if os.IsNotExist(err) {
+		return quarantine, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &quarantine); err != nil {
+		return nil, fmt.Errorf("%s: %v", quarantineFile(), err)
+	}
+	for host, entry := range quarantine {
+		if time.Now().After(entry.Until) {
+			delete(quarantine, host)
+		}
+	}
+	return quarantine, nil
+}
+
+func saveQuarantine(quarantine map[string]Quarantine) error {
+	raw, err := json.MarshalIndent(quarantine, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(quarantineFile()), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(quarantineFile(), raw, 0644)
+}
+
+func applyQuarantine(servers Servers) Servers {
+	quarantine, err := getQuarantine()
+	if err != nil {
+		log.Printf("Warning: ignoring quarantine: %v", err)
+		return servers
+	}
+	for index := range servers {
+		if entry, ok := quarantine[servers[index].Name]; ok {
+			entry := entry
+			servers[index].quarantine = &entry
+		}
+	}
+	return servers
+}
+
+func (s Server) disabledReason() string {
+	if s.quarantine != nil {
+		return fmt.Sprintf("quarantined until %s: %s", s.quarantine.Until.Format(time.RFC3339), s.quarantine.Reason)
+	}
+	if s.Disabled {
+		return "disabled: " + s.Reason
+	}
+	return ""
+}
+
+func (s Server) isDisabled() bool {
+	return s.Disabled || s.quarantine != nil
+}
+
+func filterDisabled(servers Servers) Servers {
+	var filtered Servers
+	for _, server := range servers {
+		if !server.isDisabled() {
+			filtered = append(filtered, server)
+		}
+	}
+	return filtered
+}
+
+// skippedServers returns the servers the selector matches but leaves out
+// because they are disabled.
+func skippedServers(servers Servers, selector Selector) Servers {
+	if selector.IncludeDisabled {
+		return nil
+	}
+	selector.IncludeDisabled = true
+	var skipped Servers
+	for _, server := range filterServers(servers, selector) {
+		if server.isDisabled() {
+			skipped = append(skipped, server)
+		}
+	}
+	return skipped
+}
+
+func quarantineCommand() cli.Command {
+	return cli.Command{
+		Name:  "quarantine",
+		Usage: "Temporarily skip servers in every selection",
+		Subcommands: []cli.Command{
+			{
+				Name:      "add",
+				Usage:     "Quarantine a server",
+				ArgsUsage: "NAME",
+				Flags: []cli.Flag{
+					cli.DurationFlag{
+						Name:  "for",
+						Value: 24 * time.Hour,
+						Usage: "Release the server after `DURATION`",
+					},
+					cli.StringFlag{
+						Name:  "reason",
+						Usage: "Why the server is quarantined",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					name := c.Args().First()
+					if name == "" {
+						log.Fatalf("Error: server name is required")
+					}
+					if c.String("reason") == "" {
+						log.Fatalf("Error: reason flag is required for quarantine")
+					}
+					quarantine, err := getQuarantine()
+					if err != nil {
+						log.Fatalf("Error: %v", err)
+					}
+					now := time.Now()
+					quarantine[name] = Quarantine{
+						Reason: c.String("reason"),
+						Owner:  currentOwner(),
+						Added:  now,
+						Until:  now.Add(c.Duration("for")),
+					}
+					if err := saveQuarantine(quarantine); err != nil {
+						log.Fatalf("Error: %v", err)
+					}
+					fmt.Printf("Quarantined %s until %s\n", name, quarantine[name].Until.Format(time.RFC3339))
+					return nil
+				},
+			},
+			{
+				Name:    "list",
+				Aliases: []string{"ls"},
+				Usage:   "List quarantined servers",
+				Action: func(c *cli.Context) error {
+					quarantine, err := getQuarantine()
+					if err != nil {
+						log.Fatalf("Error: %v", err)
+					}
+					var names []string
+					for name := range quarantine {
+						names = append(names, name)
+					}
+					sort.Strings(names)
+					for _, name := range names {
+						entry := quarantine[name]
+						fmt.Printf("%s %s %s %q\n", name, entry.Until.Format(time.RFC3339), entry.Owner, entry.Reason)
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "remove",
+				Aliases:   []string{"rm"},
+				Usage:     "Release a quarantined server",
+				ArgsUsage: "NAME",
+				Action: func(c *cli.Context) error {
+					quarantine, err := getQuarantine()
+					if err != nil {
+						log.Fatalf("Error: %v", err)
+					}
+					if _, ok := quarantine[c.Args().First()]; !ok {
+						log.Fatalf("Error: %s is not quarantined", c.Args().First())
+					}
+					delete(quarantine, c.Args().First())
+					return saveQuarantine(quarantine)
+				},
+			},
+		},
+	}
+}
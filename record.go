@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/kr/pty"
+	"github.com/urfave/cli"
+)
+
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Recorder writes everything passed to Write as output events of an
+// asciicast v2 file, timed relative to its creation.
+type Recorder struct {
+	mutex   sync.Mutex
+	file    *os.File
+	start   time.Time
+	crlf    bool
+	pending []byte
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+func recordingPath(dir string, name string) string {
+	stamp := time.Now().Format("20060102-150405")
+	return filepath.Join(dir, stamp+"-"+unsafeFileChars.ReplaceAllString(name, "_")+".cast")
+}
+
+func terminalSize() (width int, height int) {
+	rows, cols, err := pty.Getsize(os.Stdout)
+	if err != nil || rows == 0 || cols == 0 {
+		return 80, 24
+	}
+	return cols, rows
+}
+
+// newRecorder creates an asciicast file in dir. Output that does not come
+// from a terminal should set crlf, so that bare newlines are replayed the way
+// a terminal would have displayed them.
+func newRecorder(dir string, name string, title string, crlf bool) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(recordingPath(dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	width, height := terminalSize()
+	start := time.Now()
+	header, _ := json.Marshal(castHeader{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: start.Unix(),
+		Title:     title,
+		Env:       map[string]string{"SHELL": os.Getenv("SHELL"), "TERM": os.Getenv("TERM")},
+	})
+	if _, err := fmt.Fprintf(file, "%s\n", header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Recorder{file: file, start: start, crlf: crlf}, nil
+}
+
+func (r *Recorder) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	data := append(r.pending, p...)
+	// hold back a trailing partial UTF-8 sequence until the rest arrives
+	cut := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	r.pending = append([]byte(nil), data[cut:]...)
+	if err := r.writeEvent(data[:cut]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (r *Recorder) writeEvent(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if r.crlf {
+		data = bytes.Replace(bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1), []byte("\n"), []byte("\r\n"), -1)
+	}
+	event, err := json.Marshal([]interface{}{time.Since(r.start).Seconds(), "o", string(data)})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(r.file, "%s\n", event)
+	return err
+}
+
+// Close writes what is still held back, an incomplete UTF-8 sequence the
+// output ended with, as a last event.
+func (r *Recorder) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	err := r.writeEvent(r.pending)
+	r.pending = nil
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func recordFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.BoolFlag{
+			Name:  "record",
+			Usage: "Record the session as asciicast v2",
+		},
+		cli.StringFlag{
+			Name:  "record-dir",
+			Value: dcrPath("recordings"),
+			Usage: "Write recordings to `DIR`",
+		},
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// relayLabel marks the servers that should be preferred as relays for their
+// group.
+const relayLabel = "relay"
+
+// RelayJob is what a relay reads on stdin: the command and the servers it
+// should fan out to.
+type RelayJob struct {
+	Command  string        `json:"command"`
+	User     string        `json:"user,omitempty"`
+	Servers  Servers       `json:"servers"`
+	Parallel int           `json:"parallel"`
+	Timeout  time.Duration `json:"timeout"`
+	Retries  int           `json:"retries"`
+}
+
+// HostResult is the result on one server as streamed back by relays and
+// kept for detached jobs.
+type HostResult struct {
+	Server   string        `json:"server"`
+	ExitCode int           `json:"exit_code"`
+	Stdout   string        `json:"stdout"`
+	Stderr   string        `json:"stderr"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+}
+
+func hostResult(result Result) HostResult {
+	return HostResult{
+		Server:   result.Server.Name,
+		ExitCode: result.ExitCode,
+		Stdout:   result.Stdout,
+		Stderr:   result.Stderr,
+		Started:  result.Started,
+		Duration: result.Duration,
+	}
+}
+
+// RelayGroup is a set of servers reached through one relay.
+type RelayGroup struct {
+	Name    string
+	Relay   Server
+	Indexes []int
+}
+
+func relayFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "relay-by",
+			Usage: "Fan out through one relay per environment (env) or per value of label `KEY`",
+		},
+		cli.BoolFlag{
+			Name:  "relay-local",
+			Usage: "Run relays as local processes instead of on the relay servers",
+		},
+	}
+}
+
+func relayGroupKey(server Server, by string) string {
+	if by == "env" {
+		return server.Environment
+	}
+	return server.Labels[by]
+}
+
+// relayGroups splits the servers into groups and picks a relay for each:
+// the first server labelled relay=true, or else the first server of the group.
+func relayGroups(servers Servers, by string) []RelayGroup {
+	byKey := map[string]*RelayGroup{}
+	var keys []string
+	for index, server := range servers {
+		key := relayGroupKey(server, by)
+		group, ok := byKey[key]
+		if !ok {
+			group = &RelayGroup{Name: key, Relay: server}
+			byKey[key] = group
+			keys = append(keys, key)
+		}
+		group.Indexes = append(group.Indexes, index)
+		if server.Labels[relayLabel] == "true" && group.Relay.Labels[relayLabel] != "true" {
+			group.Relay = server
+		}
+	}
+	sort.Strings(keys)
+	var groups []RelayGroup
+	for _, key := range keys {
+		groups = append(groups, *byKey[key])
+	}
+	return groups
+}
+
+// relayProcess starts the relay for a group. Local relays are this dcr
+// binary, run with the same transport settings.
+func relayProcess(c *cli.Context, relay Server, user string) *exec.Cmd {
+	if !c.Bool("relay-local") {
+		return transportCommand(relay, user, "dcr relay")
+	}
+	args := []string{"--transport", c.GlobalString("transport"), "--simulation", c.GlobalString("simulation")}
+	if c.GlobalIsSet("seed") {
+		args = append(args, "--seed", strconv.FormatInt(c.GlobalInt64("seed"), 10))
+	}
+	return exec.Command(os.Args[0], append(args, "relay")...)
+}
+
+// runRelays runs the command through one relay per group and hands every
+// result to done as it streams in. Relays are killed once stop reports true.
+// Servers a relay did not report on fail with exit code 255.
+func runRelays(c *cli.Context, run Run, stop func() bool, done func(index int, result Result)) {
+	groups := relayGroups(run.Servers, c.String("relay-by"))
+	var wg sync.WaitGroup
+	for _, group := range groups {
+		wg.Add(1)
+		go func(group RelayGroup) {
+			defer wg.Done()
+			job := RelayJob{
+				Command:  run.script(),
+				User:     run.User,
+				Parallel: c.Int("parallel"),
+				Timeout:  c.Duration("timeout"),
+				Retries:  c.Int("retries"),
+			}
+			indexes := map[string]int{}
+			for _, index := range group.Indexes {
+				job.Servers = append(job.Servers, run.Servers[index])
+				indexes[run.Servers[index].Name] = index
+			}
+			err := streamRelay(relayProcess(c, group.Relay, run.User), job, stop, func(relayed HostResult) {
+				index, ok := indexes[relayed.Server]
+				if !ok {
+					return
+				}
+				delete(indexes, relayed.Server)
+				done(index, Result{
+					Server:   run.Servers[index],
+					ExitCode: relayed.ExitCode,
+					Stdout:   relayed.Stdout,
+					Stderr:   relayed.Stderr,
+					Started:  relayed.Started,
+					Duration: relayed.Duration,
+				})
+			})
+			if stop() {
+				return
+			}
+			for _, index := range indexes {
+				message := fmt.Sprintf("relay %s exited without a result", group.Relay.Name)
+				if err != nil {
+					message = fmt.Sprintf("relay %s: %v", group.Relay.Name, err)
+				}
+				done(index, Result{Server: run.Servers[index], ExitCode: 255, Stderr: message, Started: time.Now()})
+			}
+		}(group)
+	}
+	wg.Wait()
+}
+
+func streamRelay(cmd *exec.Cmd, job RelayJob, stop func() bool, result func(HostResult)) error {
+	input, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var relayed HostResult
+		if err := json.Unmarshal(scanner.Bytes(), &relayed); err != nil {
+			continue
+		}
+		result(relayed)
+		if stop() {
+			cmd.Process.Kill()
+			break
+		}
+	}
+	if err := cmd.Wait(); err != nil && !stop() {
+		if stderr.Len() > 0 {
+			return fmt.Errorf("%v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+		}
+		return err
+	}
+	return nil
+}
+
+func relayCommand() cli.Command {
+	return cli.Command{
+		Name:   "relay",
+		Usage:  "Run a relay job read from stdin and stream the results as JSON lines",
+		Hidden: true,
+		Action: func(c *cli.Context) error {
+			var job RelayJob
+			if err := json.NewDecoder(os.Stdin).Decode(&job); err != nil {
+				log.Fatalf("Error: reading relay job: %v", err)
+			}
+			// secrets travel encrypted, the relay needs the secret key to use them
+			if err := decryptServers(job.Servers); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			parallel := job.Parallel
+			if parallel < 1 {
+				parallel = 1
+			}
+			run := Run{Command: job.Command, User: job.User, Servers: job.Servers}
+			encoder := json.NewEncoder(os.Stdout)
+			var mutex sync.Mutex
+			var wg sync.WaitGroup
+			jobs := make(chan Server)
+			for worker := 0; worker < parallel; worker++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for server := range jobs {
+						result := runOnServer(server, run, nil, job.Timeout, job.Retries)
+						mutex.Lock()
+						encoder.Encode(hostResult(result))
+						mutex.Unlock()
+					}
+				}()
+			}
+			for _, server := range job.Servers {
+				jobs <- server
+			}
+			close(jobs)
+			wg.Wait()
+			return nil
+		},
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runAsDCR makes the test binary behave like dcr, so that commands which
+// start dcr again, such as local relays, can be tested.
+const runAsDCR = "DCR_TEST_RUN_AS_DCR"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runAsDCR) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// runDCR runs dcr with its state in dir.
+func runDCR(t *testing.T, dir string, env []string, args ...string) string {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(append(os.Environ(), runAsDCR+"=1", "HOME="+dir), env...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("dcr %s: %v\n%s", strings.Join(args, " "), err, output)
+	}
+	return string(output)
+}
+
+func TestRelayLocal(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{
+		"servers.json": `[
+  {"name": "web01", "environment": "prod", "labels": {"zone": "a"}},
+  {"name": "web02", "environment": "prod", "labels": {"zone": "b", "relay": "true"}},
+  {"name": "db01", "environment": "prod", "labels": {"zone": "b"}}
+]`,
+		"simulation.yaml": `default:
+  stdout: default output
+hosts:
+  - match: "web*"
+    stdout: web output
+`,
+	})
+	output := runDCR(t, dir, nil,
+		"-c", filepath.Join(dir, "servers.json"), "-e", "prod",
+		"--transport", "simulate", "--simulation", filepath.Join(dir, "simulation.yaml"),
+		"exec", "--relay-by", "zone", "--relay-local", "--lock-scope", "none", "uptime")
+	for _, line := range []string{"web01] STDOUT: web output", "web02] STDOUT: web output", "db01] STDOUT: default output"} {
+		if !strings.Contains(output, line) {
+			t.Errorf("output does not contain %q:\n%s", line, output)
+		}
+	}
+	if strings.Contains(output, "relay ") {
+		t.Errorf("relay failed:\n%s", output)
+	}
+}
+
+// Relays get the servers with their secrets still encrypted and have to
+// decrypt them before handing them to the transport.
+func TestRelayLocalSecrets(t *testing.T) {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		t.Fatal(err)
+	}
+	password, err := encryptValue(&key, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{
+		"servers.json": `[{"name": "web01", "environment": "prod", "password": "` + password + `"}]`,
+		"pmrun":        "#!/bin/sh\necho \"pw=$DCR_PASSWORD\"\n",
+	})
+	env := []string{
+		"DCR_SECRET_KEY=" + base64.StdEncoding.EncodeToString(key[:]),
+		"PATH=" + dir + string(os.PathListSeparator) + os.Getenv("PATH"),
+	}
+	for _, relay := range [][]string{nil, {"--relay-by", "env", "--relay-local"}} {
+		args := append([]string{"-c", filepath.Join(dir, "servers.json"), "-e", "prod", "--transport", "pmrun", "exec", "--lock-scope", "none"}, relay...)
+		output := runDCR(t, dir, env, append(args, "true")...)
+		if !strings.Contains(output, "pw=hunter2") {
+			t.Errorf("exec %q does not pass the decrypted password:\n%s", relay, output)
+		}
+	}
+}
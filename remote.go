@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// RemoteRun is a command left running on the servers by exec --remote-detach.
+// Its output and exit status stay on each server in remoteRunDir until they
+// are collected.
+type RemoteRun struct {
+	ID          string    `json:"id"`
+	Command     string    `json:"command"`
+	User        string    `json:"user,omitempty"`
+	Environment string    `json:"environment"`
+	Hosts       []string  `json:"hosts"`
+	Started     time.Time `json:"started"`
+	// Locks are the run locks, held until the command finished everywhere.
+	Locks   []Lock        `json:"locks,omitempty"`
+	LockTTL time.Duration `json:"lock_ttl,omitempty"`
+}
+
+func remoteRunDir(id string) string {
+	return `"$HOME"/.dcr-runs/` + shellQuote(id)
+}
+
+func remoteRunFile(id string) string {
+	return dcrPath(filepath.Join("remote-runs", unsafeFileChars.ReplaceAllString(id, "_")+".json"))
+}
+
+// remoteStartScript starts the command in a session of its own, so it keeps
+// running after the connection is closed. The exit status is written last.
+func remoteStartScript(id string, command string) string {
+	return fmt.Sprintf(`dir=%s; mkdir -p "$dir" && cd "$dir" || exit 255
+printf '%%s\n' %s > command
+detach=; command -v setsid >/dev/null 2>&1 && detach=setsid
+nohup $detach sh -c 'sh -c "$1" > stdout 2> stderr; echo $? > exit.tmp; mv exit.tmp exit' sh %s < /dev/null > /dev/null 2>&1 &
+echo $! > pid
+echo "started $(cat pid)"`, remoteRunDir(id), shellQuote(command), shellQuote(command))
+}
+
+// remoteCollectScript prints "exit CODE" followed by the output of a finished
+// command, or "running" or "lost" when there is no exit status yet.
+func remoteCollectScript(id string) string {
+	return fmt.Sprintf(`dir=%s; cd "$dir" 2>/dev/null || { echo lost; exit 0; }
+if [ -f exit ]; then echo "exit $(cat exit)"; cat stdout; cat stderr >&2
+elif [ -f pid ] && kill -0 "$(cat pid)" 2>/dev/null; then echo running
+else echo lost; fi`, remoteRunDir(id))
+}
+
+func readRemoteRun(id string) (RemoteRun, error) {
+	var run RemoteRun
+	raw, err := ioutil.ReadFile(remoteRunFile(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return run, fmt.Errorf("no remote run %s", id)
+		}
+		return run, err
+	}
+	err = json.Unmarshal(raw, &run)
+	return run, err
+}
+
+func writeRemoteRun(run RemoteRun) error {
+	raw, err := json.MarshalIndent(run, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(remoteRunFile(run.ID)), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(remoteRunFile(run.ID), raw, 0644)
+}
+
+// collectLocks renews the locks of a remote run while it may still be
+// running, and releases them once it finished everywhere. Between collects
+// they expire after the lock TTL, like the locks of a crashed run.
+func collectLocks(dir string, remote *RemoteRun, running bool) error {
+	if len(remote.Locks) == 0 {
+		return nil
+	}
+	var kept []Lock
+	for _, lock := range remote.Locks {
+		if !running {
+			if err := releaseOwnLock(dir, lock); err != nil {
+				return err
+			}
+			continue
+		}
+		lock.Expires = time.Now().Add(remote.LockTTL)
+		if lost, err := renewLock(dir, lock); lost {
+			log.Printf("Warning: lost lock %s: %v", lock.Name, err)
+			continue
+		} else if err != nil {
+			return err
+		}
+		kept = append(kept, lock)
+	}
+	if running && len(kept) != 0 {
+		names := make([]string, len(kept))
+		for index, lock := range kept {
+			names[index] = lock.Name
+		}
+		fmt.Printf("Keeping %s until the command finished everywhere (expires %s)\n", strings.Join(names, ", "), kept[0].Expires.Format(time.RFC3339))
+	}
+	remote.Locks = kept
+	return writeRemoteRun(*remote)
+}
+
+func remoteDetachFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.BoolFlag{
+			Name:  "remote-detach",
+			Usage: "Leave the command running on the servers and collect it later with 'dcr collect', which releases the run locks once it finished",
+		},
+	}
+}
+
+func collectCommand() cli.Command {
+	return cli.Command{
+		Name:      "collect",
+		Usage:     "Fetch the results of a command started with exec --remote-detach",
+		ArgsUsage: "RUN-ID",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "clean",
+				Usage: "Remove the results of finished commands from the servers",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			remote, err := readRemoteRun(c.Args().First())
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			servers := map[string]Server{}
+			for _, server := range getServers(c.GlobalString("config")) {
+				servers[server.Name] = server
+			}
+
+			user := defaultUser(c.GlobalString("settings"), remote.Environment, remote.User)
+			var running, lost, unreachable []string
+			for _, host := range remote.Hosts {
+				server, ok := servers[host]
+				if !ok {
+					fmt.Printf("\n%s is no longer in the servers file\n", host)
+					lost = append(lost, host)
+					continue
+				}
+				exitCode, stdout, stderr := execCommand(server, user, remoteCollectScript(remote.ID), nil, 0)
+				status := strings.SplitN(stdout, "\n", 2)
+				switch {
+				case exitCode != 0:
+					fmt.Printf("\n%2s[%10s] cannot collect: %s\n", colorizeExitCode(exitCode), host, strings.Trim(stderr, "\n"))
+					unreachable = append(unreachable, host)
+				case status[0] == "running":
+					running = append(running, host)
+				case strings.HasPrefix(status[0], "exit "):
+					code, _ := strconv.Atoi(strings.TrimPrefix(status[0], "exit "))
+					output := ""
+					if len(status) > 1 {
+						output = status[1]
+					}
+					fmt.Printf("\n%2s[%10s] STDOUT: %10s\n", colorizeExitCode(code), host, strings.Trim(output, "\n"))
+					if stderr != "" {
+						fmt.Printf("STDERR: %s\n", strings.Trim(stderr, "\n"))
+					}
+					if c.Bool("clean") {
+						execCommand(server, user, "rm -rf "+remoteRunDir(remote.ID), nil, 0)
+					}
+				default:
+					lost = append(lost, host)
+				}
+			}
+			fmt.Println()
+			if err := collectLocks(c.GlobalString("lock-dir"), &remote, len(running) != 0 || len(unreachable) != 0); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			if len(running) != 0 {
+				fmt.Printf("Still running on %d servers: %s\n", len(running), strings.Join(running, ", "))
+			}
+			if len(unreachable) != 0 {
+				fmt.Printf("Could not reach %d servers: %s\n", len(unreachable), strings.Join(unreachable, ", "))
+			}
+			if len(lost) != 0 {
+				fmt.Printf("No result and not running on %d servers: %s\n", len(lost), strings.Join(lost, ", "))
+			}
+			return nil
+		},
+	}
+}
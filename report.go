@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"html/template"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Result struct {
+	Server   Server
+	ExitCode int
+	Stdout   string
+	Stderr   string
+	Started  time.Time
+	Duration time.Duration
+}
+
+type Report struct {
+	Run      Run
+	Operator string
+	Started  time.Time
+	Finished time.Time
+	Results  []Result
+	Failed   int
+	// NotRun are the servers that were not started after --max-failures.
+	NotRun Servers
+}
+
+func newReport(run Run, results []Result, notRun Servers, started time.Time) Report {
+	sorted := append([]Result(nil), results...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].ExitCode != 0 && sorted[j].ExitCode == 0
+	})
+	failed := 0
+	for _, result := range sorted {
+		if result.ExitCode != 0 {
+			failed++
+		}
+	}
+	return Report{
+		Run:      run,
+		Operator: currentOwner(),
+		Started:  started,
+		Finished: time.Now(),
+		Results:  sorted,
+		Failed:   failed,
+		NotRun:   notRun,
+	}
+}
+
+// Hosts is the number of servers the run was for, whether they were run or not.
+func (r Report) Hosts() int {
+	return len(r.Results) + len(r.NotRun)
+}
+
+var htmlReport = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>dcr exec {{.Run.Command}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+.failed { background: #fdd; }
+.not-run { background: #eee; }
+pre { background: #f4f4f4; padding: 0.5em; overflow-x: auto; }
+</style>
+</head>
+<body>
+<h1>dcr exec</h1>
+<table>
+<tr><th>Command</th><td><code>{{.Run.Command}}</code></td></tr>
+<tr><th>Environment</th><td>{{.Run.Environment}}</td></tr>
+<tr><th>User</th><td>{{.Run.User}}</td></tr>
+<tr><th>Operator</th><td>{{.Operator}}</td></tr>
+<tr><th>Started</th><td>{{.Started.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+<tr><th>Finished</th><td>{{.Finished.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+<tr><th>Hosts</th><td>{{.Hosts}} ({{.Failed}} failed{{if .NotRun}}, {{len .NotRun}} not run{{end}}{{if .Run.Skipped}}, {{len .Run.Skipped}} skipped{{end}})</td></tr>
+</table>
+<h2>Summary</h2>
+<table>
+<tr><th>Host</th><th>Environment</th><th>Exit</th><th>Duration</th></tr>
+{{range .Results}}<tr{{if .ExitCode}} class="failed"{{end}}><td>{{.Server.Name}}</td><td>{{.Server.Environment}}</td><td>{{.ExitCode}}</td><td>{{.Duration}}</td></tr>
+{{end}}{{range .NotRun}}<tr class="not-run"><td>{{.Name}}</td><td>{{.Environment}}</td><td>not run</td><td>-</td></tr>
+{{end}}</table>
+<h2>Output</h2>
+{{range .Results}}<details{{if .ExitCode}} open{{end}}>
+<summary>{{.Server.Name}} (exit {{.ExitCode}})</summary>
+<h3>stdout</h3>
+<pre>{{.Stdout}}</pre>
+{{if .Stderr}}<h3>stderr</h3>
+<pre>{{.Stderr}}</pre>
+{{end}}</details>
+{{end}}</body>
+</html>
+`))
+
+func markdownCell(value string) string {
+	return strings.Replace(html.EscapeString(value), "|", "\\|", -1)
+}
+
+func markdownReport(report Report) []byte {
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "# dcr exec\n\n")
+	fmt.Fprintf(&buffer, "| | |\n|---|---|\n")
+	fmt.Fprintf(&buffer, "| Command | <code>%s</code> |\n", markdownCell(report.Run.Command))
+	fmt.Fprintf(&buffer, "| Environment | %s |\n", markdownCell(report.Run.Environment))
+	fmt.Fprintf(&buffer, "| User | %s |\n", markdownCell(report.Run.User))
+	fmt.Fprintf(&buffer, "| Operator | %s |\n", markdownCell(report.Operator))
+	fmt.Fprintf(&buffer, "| Started | %s |\n", report.Started.Format("2006-01-02 15:04:05 MST"))
+	fmt.Fprintf(&buffer, "| Finished | %s |\n", report.Finished.Format("2006-01-02 15:04:05 MST"))
+	fmt.Fprintf(&buffer, "| Hosts | %d (%d failed, %d not run, %d skipped) |\n\n", report.Hosts(), report.Failed, len(report.NotRun), len(report.Run.Skipped))
+
+	fmt.Fprintf(&buffer, "## Summary\n\n| Host | Environment | Exit | Duration |\n|---|---|---|---|\n")
+	for _, result := range report.Results {
+		fmt.Fprintf(&buffer, "| %s | %s | %d | %s |\n", markdownCell(result.Server.Name), markdownCell(result.Server.Environment), result.ExitCode, result.Duration)
+	}
+	for _, server := range report.NotRun {
+		fmt.Fprintf(&buffer, "| %s | %s | not run | - |\n", markdownCell(server.Name), markdownCell(server.Environment))
+	}
+
+	fmt.Fprintf(&buffer, "\n## Output\n\n")
+	for _, result := range report.Results {
+		fmt.Fprintf(&buffer, "<details><summary>%s (exit %d)</summary>\n\n", html.EscapeString(result.Server.Name), result.ExitCode)
+		fmt.Fprintf(&buffer, "<pre>%s</pre>\n", html.EscapeString(result.Stdout))
+		if result.Stderr != "" {
+			fmt.Fprintf(&buffer, "\nstderr:\n\n<pre>%s</pre>\n", html.EscapeString(result.Stderr))
+		}
+		fmt.Fprintf(&buffer, "\n</details>\n\n")
+	}
+	return buffer.Bytes()
+}
+
+func reportFormat(file string) (string, error) {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".html", ".htm":
+		return "html", nil
+	case ".md", ".markdown":
+		return "markdown", nil
+	default:
+		return "", fmt.Errorf("unknown report format %q, use .html or .md", filepath.Ext(file))
+	}
+}
+
+func writeReport(file string, report Report) error {
+	format, err := reportFormat(file)
+	if err != nil {
+		return err
+	}
+	if format == "markdown" {
+		return ioutil.WriteFile(file, markdownReport(report), 0644)
+	}
+	var buffer bytes.Buffer
+	if err := htmlReport.Execute(&buffer, report); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, buffer.Bytes(), 0644)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schemaGenerator derives a JSON Schema from Go types, so the schema of the
+// servers file follows the struct definitions. Struct fields are described
+// by their json tag, and optionally by description and enum tags. Fields
+// are required unless they are omitempty or tagged optional:"true".
+type schemaGenerator struct {
+	definitions map[string]interface{}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaProvider is implemented by types whose JSON form differs from their
+// Go structure.
+type schemaProvider interface {
+	jsonSchema() map[string]interface{}
+}
+
+var schemaProviderType = reflect.TypeOf((*schemaProvider)(nil)).Elem()
+
+func parseEnum(t reflect.Type, enum string) []interface{} {
+	var values []interface{}
+	for _, value := range strings.Split(enum, ",") {
+		switch t.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if number, err := strconv.Atoi(value); err == nil {
+				values = append(values, number)
+			}
+		default:
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func (g *schemaGenerator) schemaFor(t reflect.Type) map[string]interface{} {
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	if t.Kind() != reflect.Ptr && t.Implements(schemaProviderType) {
+		return reflect.Zero(t).Interface().(schemaProvider).jsonSchema()
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schemaFor(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": g.schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schemaFor(t.Elem())}
+	case reflect.Struct:
+		if _, ok := g.definitions[t.Name()]; !ok {
+			g.definitions[t.Name()] = nil
+			g.definitions[t.Name()] = g.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/definitions/" + t.Name()}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+func (g *schemaGenerator) structSchema(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(field.Tag.Get("json"), ",")
+		name := tag[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		property := g.schemaFor(field.Type)
+		if description := field.Tag.Get("description"); description != "" {
+			property["description"] = description
+		}
+		if enum := field.Tag.Get("enum"); enum != "" {
+			property["enum"] = parseEnum(field.Type, enum)
+		}
+		properties[name] = property
+		if !contains(tag[1:], "omitempty") && field.Tag.Get("optional") != "true" {
+			required = append(required, name)
+		}
+	}
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"required":             required,
+		"additionalProperties": false,
+	}
+}
+
+func inventorySchema() map[string]interface{} {
+	generator := schemaGenerator{definitions: map[string]interface{}{}}
+	return map[string]interface{}{
+		"$schema": "http://json-schema.org/draft-07/schema#",
+		"title":   "dcr servers file",
+		"oneOf": []interface{}{
+			generator.schemaFor(reflect.TypeOf(Inventory{})),
+			map[string]interface{}{
+				"description": "Version 1: a bare array of servers",
+				"type":        "array",
+				"items":       generator.schemaFor(reflect.TypeOf(Server{})),
+			},
+		},
+		"definitions": generator.definitions,
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const secretPrefix = "enc:"
+
+var unsafeEnvChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// Secret is an inventory value that may be encrypted with the secret key.
+// It is marshalled back exactly as it was read, so decrypted values never
+// leave dcr through its JSON output.
+type Secret struct {
+	value string
+	plain string
+}
+
+func (s *Secret) UnmarshalJSON(raw []byte) error {
+	if err := json.Unmarshal(raw, &s.value); err != nil {
+		return err
+	}
+	s.plain = s.value
+	return nil
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.value)
+}
+
+func (s Secret) jsonSchema() map[string]interface{} {
+	return map[string]interface{}{
+		"type":        "string",
+		"description": "Plain value, or one encrypted with 'dcr config encrypt-value'",
+	}
+}
+
+func (s Secret) Encrypted() bool {
+	return strings.HasPrefix(s.value, secretPrefix)
+}
+
+func (s Secret) Plain() string {
+	return s.plain
+}
+
+func secretKeyFile() string {
+	return dcrPath("secret.key")
+}
+
+// loadSecretKey reads the base64 encoded key from DCR_SECRET_KEY, or from the
+// secret key file when the variable is not set.
+func loadSecretKey() (*[32]byte, error) {
+	encoded := os.Getenv("DCR_SECRET_KEY")
+	if encoded == "" {
+		raw, err := ioutil.ReadFile(secretKeyFile())
+		if err != nil {
+			return nil, fmt.Errorf("no secret key: set DCR_SECRET_KEY or create %s with 'dcr config secret-keygen'", secretKeyFile())
+		}
+		encoded = string(raw)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(decoded) != 32 {
+		return nil, errors.New("secret key must be 32 bytes, base64 encoded")
+	}
+	var key [32]byte
+	copy(key[:], decoded)
+	return &key, nil
+}
+
+func encryptValue(key *[32]byte, plain string) (string, error) {
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return "", err
+	}
+	sealed := secretbox.Seal(nonce[:], []byte(plain), &nonce, key)
+	return secretPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptValue(key *[32]byte, value string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, secretPrefix))
+	if err != nil || len(sealed) < 24 {
+		return "", errors.New("malformed encrypted value")
+	}
+	var nonce [24]byte
+	copy(nonce[:], sealed[:24])
+	plain, ok := secretbox.Open(nil, sealed[24:], &nonce, key)
+	if !ok {
+		return "", errors.New("cannot decrypt value, wrong secret key?")
+	}
+	return string(plain), nil
+}
+
+func (s *Secret) decrypt(key *[32]byte) error {
+	if !s.Encrypted() {
+		return nil
+	}
+	plain, err := decryptValue(key, s.value)
+	if err != nil {
+		return err
+	}
+	s.plain = plain
+	return nil
+}
+
+func (s Server) secrets() map[string]*Secret {
+	secrets := map[string]*Secret{}
+	if s.Password != nil {
+		secrets["password"] = s.Password
+	}
+	for name, secret := range s.Secrets {
+		if secret != nil {
+			secrets["secrets."+name] = secret
+		}
+	}
+	return secrets
+}
+
+// secretEnv are the secrets of the server as DCR_PASSWORD and
+// DCR_SECRET_<NAME> variables. Unlike arguments, they are not visible to
+// other users in the process list.
+func secretEnv(server Server) []string {
+	var env []string
+	for name, secret := range server.secrets() {
+		variable := "DCR_PASSWORD"
+		if name != "password" {
+			variable = "DCR_SECRET_" + strings.ToUpper(unsafeEnvChars.ReplaceAllString(strings.TrimPrefix(name, "secrets."), "_"))
+		}
+		env = append(env, variable+"="+secret.Plain())
+	}
+	sort.Strings(env)
+	return env
+}
+
+// decryptServers decrypts all encrypted values in place. The key is only
+// needed when the inventory contains encrypted values.
+func decryptServers(servers Servers) error {
+	var key *[32]byte
+	for _, server := range servers {
+		for name, secret := range server.secrets() {
+			if !secret.Encrypted() {
+				continue
+			}
+			if key == nil {
+				var err error
+				if key, err = loadSecretKey(); err != nil {
+					return err
+				}
+			}
+			if err := secret.decrypt(key); err != nil {
+				return fmt.Errorf("%s %s: %v", server.Name, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func secretCommands() []cli.Command {
+	return []cli.Command{
+		{
+			Name:  "secret-keygen",
+			Usage: "Create the key used for encrypted inventory values",
+			Action: func(c *cli.Context) error {
+				if _, err := os.Stat(secretKeyFile()); err == nil {
+					log.Fatalf("Error: %s already exists", secretKeyFile())
+				}
+				var key [32]byte
+				if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+					log.Fatalf("Error: %v", err)
+				}
+				if err := os.MkdirAll(filepath.Dir(secretKeyFile()), 0700); err != nil {
+					log.Fatalf("Error: %v", err)
+				}
+				if err := ioutil.WriteFile(secretKeyFile(), []byte(base64.StdEncoding.EncodeToString(key[:])+"\n"), 0600); err != nil {
+					log.Fatalf("Error: %v", err)
+				}
+				fmt.Printf("Wrote %s\n", secretKeyFile())
+				return nil
+			},
+		},
+		{
+			Name:      "encrypt-value",
+			Usage:     "Encrypt a value for use in the servers file",
+			ArgsUsage: "[VALUE, read from stdin if omitted]",
+			Action: func(c *cli.Context) error {
+				key, err := loadSecretKey()
+				if err != nil {
+					log.Fatalf("Error: %v", err)
+				}
+				plain := c.Args().First()
+				if c.NArg() == 0 {
+					plain, err = bufio.NewReader(os.Stdin).ReadString('\n')
+					if err != nil && err != io.EOF {
+						log.Fatalf("Error: %v", err)
+					}
+					plain = strings.TrimRight(plain, "\r\n")
+				}
+				encrypted, err := encryptValue(key, plain)
+				if err != nil {
+					log.Fatalf("Error: %v", err)
+				}
+				fmt.Println(encrypted)
+				return nil
+			},
+		},
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// Settings holds dcr configuration that is not about individual servers. It
+// lives next to the inventory and is optional.
+type Settings struct {
+	Environments map[string]Environment `json:"environments,omitempty"`
+	Commands     map[string]Macro       `json:"commands,omitempty"`
+}
+
+type Environment struct {
+	User            string   `json:"user,omitempty"`
+	Windows         []Window `json:"windows,omitempty"`
+	Freezes         []Freeze `json:"freezes,omitempty"`
+	RequireApproval bool     `json:"require_approval,omitempty"`
+}
+
+func getSettings(settingsFile string) (Settings, error) {
+	var settings Settings
+	raw, err := ioutil.ReadFile(settingsFile)
+	if os.IsNotExist(err) {
+		return settings, nil
+	}
+	if err != nil {
+		return settings, err
+	}
+	if err := json.Unmarshal(raw, &settings); err != nil {
+		return settings, fmt.Errorf("%s: %v", settingsFile, err)
+	}
+	for name, environment := range settings.Environments {
+		for _, window := range environment.Windows {
+			if err := window.validate(); err != nil {
+				return settings, fmt.Errorf("%s: environment %s: %v", settingsFile, name, err)
+			}
+		}
+	}
+	return settings, nil
+}
+
+// defaultUser returns user, or the default user of the environment when no
+// user was given.
+func defaultUser(settingsFile string, environment string, user string) string {
+	if user != "" {
+		return user
+	}
+	settings, err := getSettings(settingsFile)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	return settings.Environments[environment].User
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"math/rand"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Behaviour describes how a simulated server answers a command. Delay is
+// either fixed, uniform between min and max, or normal around mean.
+type Behaviour struct {
+	Match               string  `yaml:"match"`
+	Delay               string  `yaml:"delay"`
+	DelayMin            string  `yaml:"delay_min"`
+	DelayMax            string  `yaml:"delay_max"`
+	DelayMean           string  `yaml:"delay_mean"`
+	DelayStddev         string  `yaml:"delay_stddev"`
+	ExitCode            int     `yaml:"exit_code"`
+	Stdout              string  `yaml:"stdout"`
+	StdoutFile          string  `yaml:"stdout_file"`
+	Stderr              string  `yaml:"stderr"`
+	FailRate            float64 `yaml:"fail_rate"`
+	FailExitCode        int     `yaml:"fail_exit_code"`
+	HangRate            float64 `yaml:"hang_rate"`
+	ConnectionErrorRate float64 `yaml:"connection_error_rate"`
+}
+
+// Simulation is loaded from a YAML file. The first host behaviour whose
+// match pattern fits a server name applies, otherwise the default one.
+type Simulation struct {
+	Seed    int64       `yaml:"seed"`
+	Default Behaviour   `yaml:"default"`
+	Hosts   []Behaviour `yaml:"hosts"`
+
+	dir string
+}
+
+func parseDelay(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	delay, _ := time.ParseDuration(value)
+	return delay
+}
+
+func (b Behaviour) validate() error {
+	for _, value := range []string{b.Delay, b.DelayMin, b.DelayMax, b.DelayMean, b.DelayStddev} {
+		if value == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(value); err != nil {
+			return err
+		}
+	}
+	if b.Match != "" {
+		if _, err := path.Match(b.Match, ""); err != nil {
+			return fmt.Errorf("match %q: %v", b.Match, err)
+		}
+	}
+	return nil
+}
+
+func loadSimulation(file string) (Simulation, error) {
+	var simulation Simulation
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return simulation, err
+	}
+	if err := yaml.Unmarshal(raw, &simulation); err != nil {
+		return simulation, fmt.Errorf("%s: %v", file, err)
+	}
+	for _, behaviour := range append([]Behaviour{simulation.Default}, simulation.Hosts...) {
+		if err := behaviour.validate(); err != nil {
+			return simulation, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	simulation.dir = filepath.Dir(file)
+	return simulation, nil
+}
+
+func (s Simulation) behaviour(name string) Behaviour {
+	for _, behaviour := range s.Hosts {
+		if matched, _ := path.Match(behaviour.Match, name); matched {
+			return behaviour
+		}
+	}
+	return s.Default
+}
+
+func (b Behaviour) delay(random *rand.Rand) time.Duration {
+	switch {
+	case b.DelayMin != "" || b.DelayMax != "":
+		min, max := parseDelay(b.DelayMin), parseDelay(b.DelayMax)
+		if max <= min {
+			return min
+		}
+		return min + time.Duration(random.Int63n(int64(max-min)))
+	case b.DelayMean != "":
+		delay := time.Duration(random.NormFloat64()*float64(parseDelay(b.DelayStddev))) + parseDelay(b.DelayMean)
+		if delay < 0 {
+			return 0
+		}
+		return delay
+	default:
+		return parseDelay(b.Delay)
+	}
+}
+
+// simulateTransport replaces the remote side with a local shell script.
+// Every server gets its own random sequence derived from the seed, so runs
+// are reproducible regardless of the order or parallelism of execution.
+type simulateTransport struct {
+	simulation Simulation
+	mutex      sync.Mutex
+	calls      map[string]int64
+}
+
+func newSimulateTransport(simulation Simulation) *simulateTransport {
+	return &simulateTransport{simulation: simulation, calls: map[string]int64{}}
+}
+
+func (t *simulateTransport) random(name string) *rand.Rand {
+	t.mutex.Lock()
+	call := t.calls[name]
+	t.calls[name]++
+	t.mutex.Unlock()
+	hash := fnv.New64a()
+	hash.Write([]byte(name))
+	return rand.New(rand.NewSource(t.simulation.Seed ^ int64(hash.Sum64()) + call))
+}
+
+func (t *simulateTransport) script(server Server, command string) string {
+	behaviour := t.simulation.behaviour(server.Name)
+	random := t.random(server.Name)
+	var script []string
+	if delay := behaviour.delay(random); delay > 0 {
+		script = append(script, fmt.Sprintf("sleep %.3f", delay.Seconds()))
+	}
+	if random.Float64() < behaviour.ConnectionErrorRate {
+		return strings.Join(append(script,
+			fmt.Sprintf("echo %s >&2", shellQuote("simulate: connect to host "+server.Name+": Connection refused")),
+			"exit 255"), "; ")
+	}
+	if random.Float64() < behaviour.HangRate {
+		return strings.Join(append(script, "exec sleep 2147483647"), "; ")
+	}
+	if command == "" {
+		return strings.Join(append(script, "exec sh"), "; ")
+	}
+	if behaviour.StdoutFile != "" {
+		file := behaviour.StdoutFile
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(t.simulation.dir, file)
+		}
+		script = append(script, "cat "+shellQuote(file))
+	}
+	if behaviour.Stdout != "" {
+		script = append(script, "printf '%s\\n' "+shellQuote(behaviour.Stdout))
+	}
+	if behaviour.Stderr != "" {
+		script = append(script, "printf '%s\\n' "+shellQuote(behaviour.Stderr)+" >&2")
+	}
+	exitCode := behaviour.ExitCode
+	if random.Float64() < behaviour.FailRate {
+		exitCode = behaviour.FailExitCode
+		if exitCode == 0 {
+			exitCode = 1
+		}
+	}
+	return strings.Join(append(script, fmt.Sprintf("exit %d", exitCode)), "; ")
+}
+
+func (t *simulateTransport) Command(server Server, user string, command string) *exec.Cmd {
+	return exec.Command("sh", "-c", t.script(server, command))
+}
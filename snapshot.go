@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+type SnapshotEntry struct {
+	ExitCode int    `json:"exit_code"`
+	Output   string `json:"output"`
+}
+
+// Snapshot is the baseline output of a command on each server it ran on.
+type Snapshot struct {
+	Name     string                   `json:"name"`
+	Command  string                   `json:"command"`
+	User     string                   `json:"user,omitempty"`
+	Selector Selector                 `json:"selector"`
+	Created  time.Time                `json:"created"`
+	Hosts    map[string]SnapshotEntry `json:"hosts"`
+}
+
+func snapshotFile(name string) string {
+	return dcrPath(filepath.Join("snapshots", unsafeFileChars.ReplaceAllString(name, "_")+".json"))
+}
+
+// normalizeOutput drops differences that are not drift: line endings,
+// trailing whitespace and blank lines around the output.
+func normalizeOutput(output string) string {
+	lines := strings.Split(strings.Replace(output, "\r\n", "\n", -1), "\n")
+	for index, line := range lines {
+		lines[index] = strings.TrimRight(line, " \t\r")
+	}
+	return strings.Trim(strings.Join(lines, "\n"), "\n")
+}
+
+func takeSnapshot(servers Servers, user string, command string) map[string]SnapshotEntry {
+	hosts := map[string]SnapshotEntry{}
+	for _, server := range servers {
+		exitCode, stdout, stderr := execCommand(server, user, command, nil, 0)
+		hosts[server.Name] = SnapshotEntry{ExitCode: exitCode, Output: normalizeOutput(stdout + stderr)}
+	}
+	return hosts
+}
+
+func readSnapshot(name string) (Snapshot, error) {
+	var snapshot Snapshot
+	raw, err := ioutil.ReadFile(snapshotFile(name))
+	if err != nil {
+		return snapshot, err
+	}
+	err = json.Unmarshal(raw, &snapshot)
+	return snapshot, err
+}
+
+func writeSnapshot(snapshot Snapshot) error {
+	raw, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(snapshotFile(snapshot.Name)), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(snapshotFile(snapshot.Name), raw, 0644)
+}
+
+func sortedHosts(hosts map[string]SnapshotEntry) []string {
+	var names []string
+	for name := range hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func snapshotCommand() cli.Command {
+	return cli.Command{
+		Name:  "snapshot",
+		Usage: "Save command output as a baseline and detect drift from it",
+		Subcommands: []cli.Command{
+			{
+				Name:      "save",
+				Usage:     "Run a command and save its output as baseline",
+				ArgsUsage: "NAME COMMAND",
+				Flags: append(selectorCommandFlags(), cli.StringFlag{
+					Name:  "user, u",
+					Usage: "User to run as",
+				}),
+				Action: func(c *cli.Context) error {
+					name, command := c.Args().Get(0), c.Args().Get(1)
+					if name == "" || command == "" {
+						log.Fatalf("Error: snapshot name and command are required")
+					}
+					selector := commandSelector(c)
+					if selector.Environment == "" {
+						log.Fatalf("Error: environment flag is required for snapshot")
+					}
+					servers := filterServers(getServers(c.GlobalString("config")), selector)
+					user := defaultUser(c.GlobalString("settings"), selector.Environment, c.String("user"))
+					snapshot := Snapshot{
+						Name:     name,
+						Command:  command,
+						User:     user,
+						Selector: selector,
+						Created:  time.Now(),
+						Hosts:    takeSnapshot(servers, user, command),
+					}
+					if err := writeSnapshot(snapshot); err != nil {
+						log.Fatalf("Error: %v", err)
+					}
+					fmt.Printf("Saved snapshot %s of %d servers\n", name, len(snapshot.Hosts))
+					return nil
+				},
+			},
+			{
+				Name:      "check",
+				Usage:     "Run the command again and report drift from the baseline",
+				ArgsUsage: "NAME",
+				Action: func(c *cli.Context) error {
+					snapshot, err := readSnapshot(c.Args().First())
+					if err != nil {
+						log.Fatalf("Error: %v", err)
+					}
+					servers := filterServers(getServers(c.GlobalString("config")), snapshot.Selector)
+					user := defaultUser(c.GlobalString("settings"), snapshot.Selector.Environment, snapshot.User)
+					current := takeSnapshot(servers, user, snapshot.Command)
+
+					drift := 0
+					for _, host := range sortedHosts(current) {
+						baseline, ok := snapshot.Hosts[host]
+						if !ok {
+							fmt.Printf("new      %s\n", host)
+							drift++
+						} else if baseline != current[host] {
+							fmt.Printf("changed  %s\n", host)
+							for _, line := range diffLines(strings.Split(baseline.Output, "\n"), strings.Split(current[host].Output, "\n")) {
+								if !strings.HasPrefix(line, " ") {
+									fmt.Printf("  %s\n", line)
+								}
+							}
+							if baseline.ExitCode != current[host].ExitCode {
+								fmt.Printf("  exit code %d -> %d\n", baseline.ExitCode, current[host].ExitCode)
+							}
+							drift++
+						}
+					}
+					for _, host := range sortedHosts(snapshot.Hosts) {
+						if _, ok := current[host]; !ok {
+							fmt.Printf("missing  %s\n", host)
+							drift++
+						}
+					}
+					if drift != 0 {
+						return cli.NewExitError(fmt.Sprintf("Drift from snapshot %s: %d differences", snapshot.Name, drift), 1)
+					}
+					fmt.Printf("No drift from snapshot %s on %d servers\n", snapshot.Name, len(current))
+					return nil
+				},
+			},
+			{
+				Name:    "list",
+				Aliases: []string{"ls"},
+				Usage:   "List saved snapshots",
+				Action: func(c *cli.Context) error {
+					files, _ := filepath.Glob(dcrPath(filepath.Join("snapshots", "*.json")))
+					for _, file := range files {
+						snapshot, err := readSnapshot(strings.TrimSuffix(filepath.Base(file), ".json"))
+						if err != nil {
+							continue
+						}
+						fmt.Printf("%s %s %d %s %q\n", snapshot.Name, snapshot.Created.Format(time.RFC3339), len(snapshot.Hosts), snapshot.Selector, snapshot.Command)
+					}
+					return nil
+				},
+			},
+		},
+	}
+}
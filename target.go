@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// Selector describes which servers of the inventory a command applies to.
+type Selector struct {
+	Environment string   `json:"env,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Labels      string   `json:"labels,omitempty"`
+	Exclude     []string `json:"exclude,omitempty"`
+
+	IncludeDisabled bool `json:"include_disabled,omitempty"`
+}
+
+func (s Selector) String() string {
+	var parts []string
+	if s.Environment != "" {
+		parts = append(parts, "-e "+s.Environment)
+	}
+	if len(s.Tags) != 0 {
+		parts = append(parts, "-t "+strings.Join(s.Tags, ","))
+	}
+	if s.Labels != "" {
+		parts = append(parts, "-l '"+s.Labels+"'")
+	}
+	if len(s.Exclude) != 0 {
+		parts = append(parts, "--exclude "+strings.Join(s.Exclude, ","))
+	}
+	if s.IncludeDisabled {
+		parts = append(parts, "--include-disabled")
+	}
+	return strings.Join(parts, " ")
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if strings.TrimSpace(item) != "" {
+			items = append(items, strings.TrimSpace(item))
+		}
+	}
+	return items
+}
+
+func selectorFlags(lookup func(name string) string) Selector {
+	return Selector{
+		Environment: lookup("env"),
+		Tags:        splitList(lookup("tags")),
+		Labels:      lookup("labels"),
+		Exclude:     splitList(lookup("exclude")),
+	}
+}
+
+func globalSelector(c *cli.Context) Selector {
+	selector := selectorFlags(c.GlobalString)
+	selector.IncludeDisabled = c.GlobalBool("include-disabled")
+	return selector
+}
+
+// selectorCommandFlags lets subcommands that store a selection take the
+// selection flags after the subcommand name.
+func selectorCommandFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "env, e",
+			Usage: "Filter by environment",
+		},
+		cli.StringFlag{
+			Name:  "tags, t",
+			Usage: "Filter by tags",
+		},
+		cli.StringFlag{
+			Name:  "labels, l",
+			Usage: "Filter by label `SELECTOR`",
+		},
+		cli.StringFlag{
+			Name:  "exclude",
+			Usage: "Skip the comma separated server `NAMES`",
+		},
+	}
+}
+
+// commandSelector reads the selectorCommandFlags, falling back to the
+// global flags for those not given.
+func commandSelector(c *cli.Context) Selector {
+	selector := selectorFlags(func(name string) string {
+		if c.IsSet(name) {
+			return c.String(name)
+		}
+		return c.GlobalString(name)
+	})
+	selector.IncludeDisabled = c.GlobalBool("include-disabled")
+	return selector
+}
+
+func targetsFile() string {
+	return dcrPath("targets.json")
+}
+
+func getTargets() (map[string]Selector, error) {
+	targets := map[string]Selector{}
+	raw, err := ioutil.ReadFile(targetsFile())
+	if os.IsNotExist(err) {
+		return targets, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &targets); err != nil {
+		return nil, fmt.Errorf("%s: %v", targetsFile(), err)
+	}
+	return targets, nil
+}
+
+func saveTargets(targets map[string]Selector) error {
+	raw, err := json.MarshalIndent(targets, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(targetsFile()), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(targetsFile(), raw, 0644)
+}
+
+// resolveSelector narrows a saved @target with the selector given on the
+// command line. Without a target the selector is returned unchanged.
+func resolveSelector(selector Selector, target string) (Selector, error) {
+	if target == "" {
+		return selector, nil
+	}
+	name := strings.TrimPrefix(target, "@")
+	targets, err := getTargets()
+	if err != nil {
+		return selector, err
+	}
+	saved, ok := targets[name]
+	if !ok {
+		return selector, fmt.Errorf("unknown target %s", name)
+	}
+	if selector.Environment != "" && saved.Environment != "" && selector.Environment != saved.Environment {
+		return selector, fmt.Errorf("target %s is for environment %s, not %s", name, saved.Environment, selector.Environment)
+	}
+	if selector.Environment == "" {
+		selector.Environment = saved.Environment
+	}
+	selector.Tags = append(saved.Tags, selector.Tags...)
+	if saved.Labels != "" && selector.Labels != "" {
+		selector.Labels = saved.Labels + "," + selector.Labels
+	} else if saved.Labels != "" {
+		selector.Labels = saved.Labels
+	}
+	selector.Exclude = append(saved.Exclude, selector.Exclude...)
+	selector.IncludeDisabled = selector.IncludeDisabled || saved.IncludeDisabled
+	return selector, nil
+}
+
+func targetCommand() cli.Command {
+	return cli.Command{
+		Name:  "target",
+		Usage: "Manage saved server selections, used as @NAME",
+		Subcommands: []cli.Command{
+			{
+				Name:      "save",
+				Usage:     "Save a selection",
+				ArgsUsage: "NAME",
+				Flags:     selectorCommandFlags(),
+				Action: func(c *cli.Context) error {
+					name := strings.TrimPrefix(c.Args().First(), "@")
+					if name == "" {
+						log.Fatalf("Error: target name is required")
+					}
+					targets, err := getTargets()
+					if err != nil {
+						log.Fatalf("Error: %v", err)
+					}
+					targets[name] = commandSelector(c)
+					if err := saveTargets(targets); err != nil {
+						log.Fatalf("Error: %v", err)
+					}
+					fmt.Printf("Saved @%s: %s\n", name, targets[name])
+					return nil
+				},
+			},
+			{
+				Name:    "list",
+				Aliases: []string{"ls"},
+				Usage:   "List saved selections and how many servers they match",
+				Action: func(c *cli.Context) error {
+					targets, err := getTargets()
+					if err != nil {
+						log.Fatalf("Error: %v", err)
+					}
+					servers := getServers(c.GlobalString("config"))
+					var names []string
+					for name := range targets {
+						names = append(names, name)
+					}
+					sort.Strings(names)
+					for _, name := range names {
+						fmt.Printf("@%s %d %s\n", name, len(filterServers(servers, targets[name])), targets[name])
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "remove",
+				Aliases:   []string{"rm"},
+				Usage:     "Delete a saved selection",
+				ArgsUsage: "NAME",
+				Action: func(c *cli.Context) error {
+					name := strings.TrimPrefix(c.Args().First(), "@")
+					targets, err := getTargets()
+					if err != nil {
+						log.Fatalf("Error: %v", err)
+					}
+					if _, ok := targets[name]; !ok {
+						log.Fatalf("Error: unknown target %s", name)
+					}
+					delete(targets, name)
+					return saveTargets(targets)
+				},
+			},
+		},
+	}
+}
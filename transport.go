@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// Transport turns a command for a server into a local process that runs it
+// there. A command of "" asks for an interactive shell.
+type Transport interface {
+	Command(server Server, user string, command string) *exec.Cmd
+}
+
+type pmrunTransport struct{}
+
+func (pmrunTransport) Command(server Server, user string, command string) *exec.Cmd {
+	if command == "" {
+		return exec.Command("pmrun", "-h", server.Name, user)
+	}
+	return exec.Command("pmrun", "-h", server.Name, user, command)
+}
+
+// dockerTransport runs commands in the container named by the server's
+// container field, or by its name.
+type dockerTransport struct{}
+
+func (dockerTransport) Command(server Server, user string, command string) *exec.Cmd {
+	container := server.Container
+	if container == "" {
+		container = server.Name
+	}
+	// stdin is always passed on, tunnels and relays write to it
+	args := []string{"exec", "-i"}
+	if command == "" {
+		args = append(args, "-t")
+	}
+	if user != "" {
+		args = append(args, "-u", user)
+	}
+	if command == "" {
+		return exec.Command("docker", append(args, container, "sh")...)
+	}
+	return exec.Command("docker", append(args, container, "sh", "-c", command)...)
+}
+
+// kubectlTransport runs commands in the server's pod, or the pod named like
+// the server. kubectl exec cannot switch users, so the user is ignored.
+type kubectlTransport struct{}
+
+func (kubectlTransport) Command(server Server, user string, command string) *exec.Cmd {
+	pod := server.Pod
+	if pod == "" {
+		pod = server.Name
+	}
+	var args []string
+	if server.Context != "" {
+		args = append(args, "--context", server.Context)
+	}
+	args = append(args, "exec", "-i")
+	if command == "" {
+		args = append(args, "-t")
+	}
+	if server.Namespace != "" {
+		args = append(args, "-n", server.Namespace)
+	}
+	args = append(args, pod)
+	if server.Container != "" {
+		args = append(args, "-c", server.Container)
+	}
+	if command == "" {
+		return exec.Command("kubectl", append(args, "--", "sh")...)
+	}
+	return exec.Command("kubectl", append(args, "--", "sh", "-c", command)...)
+}
+
+var transports = map[string]Transport{
+	"pmrun":   pmrunTransport{},
+	"docker":  dockerTransport{},
+	"kubectl": kubectlTransport{},
+}
+
+var transport Transport = pmrunTransport{}
+
+// TransportName names the transport of a server, one of transports.
+type TransportName string
+
+func (TransportName) jsonSchema() map[string]interface{} {
+	var names []string
+	for name := range transports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var enum []interface{}
+	for _, name := range names {
+		enum = append(enum, name)
+	}
+	return map[string]interface{}{"type": "string", "enum": enum}
+}
+
+// transportCommand uses the transport of the server when it has one, unless
+// all servers are simulated. The decrypted secrets of the server are passed
+// to the transport in its environment, see secretEnv.
+func transportCommand(server Server, user string, command string) *exec.Cmd {
+	var cmd *exec.Cmd
+	if _, simulated := transport.(*simulateTransport); !simulated && server.Transport != "" {
+		cmd = transports[string(server.Transport)].Command(server, user, command)
+	} else {
+		cmd = transport.Command(server, user, command)
+	}
+	if env := secretEnv(server); len(env) != 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	return cmd
+}
+
+func checkTransports(servers Servers) error {
+	for _, server := range servers {
+		if _, ok := transports[string(server.Transport)]; server.Transport != "" && !ok {
+			return fmt.Errorf("%s: unknown transport %q", server.Name, server.Transport)
+		}
+	}
+	return nil
+}
+
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
+
+func transportFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "transport",
+			Value: "pmrun",
+			Usage: "Reach servers without a transport of their own with pmrun, docker or kubectl, or simulate all servers (simulate)",
+		},
+		cli.StringFlag{
+			Name:  "simulation",
+			Value: dcrPath("simulation.yaml"),
+			Usage: "Load the simulated behaviour of servers from `FILE`",
+		},
+		cli.Int64Flag{
+			Name:  "seed",
+			Usage: "Seed for the simulation, overriding the one in the simulation file",
+		},
+	}
+}
+
+func setupTransport(c *cli.Context) error {
+	switch c.GlobalString("transport") {
+	case "pmrun", "docker", "kubectl":
+		transport = transports[c.GlobalString("transport")]
+	case "simulate":
+		simulation, err := loadSimulation(c.GlobalString("simulation"))
+		if err != nil {
+			return err
+		}
+		if c.GlobalIsSet("seed") {
+			simulation.Seed = c.GlobalInt64("seed")
+		}
+		transport = newSimulateTransport(simulation)
+	default:
+		return fmt.Errorf("unknown transport %q", c.GlobalString("transport"))
+	}
+	return nil
+}
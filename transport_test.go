@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDockerTransportArgs(t *testing.T) {
+	tests := []struct {
+		server  Server
+		user    string
+		command string
+		args    []string
+	}{
+		{Server{Name: "web"}, "", "uptime", []string{"docker", "exec", "-i", "web", "sh", "-c", "uptime"}},
+		{Server{Name: "web", Container: "web-1"}, "app", "uptime", []string{"docker", "exec", "-i", "-u", "app", "web-1", "sh", "-c", "uptime"}},
+		{Server{Name: "web"}, "app", "", []string{"docker", "exec", "-i", "-t", "-u", "app", "web", "sh"}},
+	}
+	for _, test := range tests {
+		args := dockerTransport{}.Command(test.server, test.user, test.command).Args
+		if !reflect.DeepEqual(args, test.args) {
+			t.Errorf("Command(%+v, %q, %q) = %q, want %q", test.server, test.user, test.command, args, test.args)
+		}
+	}
+}
+
+func TestKubectlTransportArgs(t *testing.T) {
+	tests := []struct {
+		server  Server
+		user    string
+		command string
+		args    []string
+	}{
+		{Server{Name: "api"}, "app", "uptime", []string{"kubectl", "exec", "-i", "api", "--", "sh", "-c", "uptime"}},
+		{
+			Server{Name: "api", Pod: "api-7d9f", Namespace: "shop", Context: "prod", Container: "app"}, "", "uptime",
+			[]string{"kubectl", "--context", "prod", "exec", "-i", "-n", "shop", "api-7d9f", "-c", "app", "--", "sh", "-c", "uptime"},
+		},
+		{Server{Name: "api", Namespace: "shop"}, "", "", []string{"kubectl", "exec", "-i", "-t", "-n", "shop", "api", "--", "sh"}},
+	}
+	for _, test := range tests {
+		args := kubectlTransport{}.Command(test.server, test.user, test.command).Args
+		if !reflect.DeepEqual(args, test.args) {
+			t.Errorf("Command(%+v, %q, %q) = %q, want %q", test.server, test.user, test.command, args, test.args)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+type Tunnel struct {
+	Server     string `json:"server"`
+	Local      string `json:"local"`
+	RemoteHost string `json:"remote_host"`
+	RemotePort int    `json:"remote_port"`
+
+	user     string
+	listener net.Listener
+	closed   bool
+	mutex    sync.Mutex
+	active   map[net.Conn]*exec.Cmd
+}
+
+func (t *Tunnel) listen() error {
+	listener, err := net.Listen("tcp", t.Local)
+	if err != nil {
+		return err
+	}
+	t.mutex.Lock()
+	t.listener = listener
+	t.Local = listener.Addr().String()
+	t.mutex.Unlock()
+	return nil
+}
+
+func (t *Tunnel) isClosed() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.closed
+}
+
+func (t *Tunnel) close() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.closed = true
+	if t.listener != nil {
+		t.listener.Close()
+	}
+	for conn, cmd := range t.active {
+		conn.Close()
+		if cmd.Process != nil {
+			cmd.Process.Kill()
+		}
+	}
+}
+
+// serve accepts local connections until the tunnel is closed. Every
+// connection gets its own relay process through the transport, so a dropped
+// relay only affects that connection; if the listener itself fails it is
+// re-opened on the same address.
+func (t *Tunnel) serve(server Server, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for !t.isClosed() {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			if t.isClosed() {
+				return
+			}
+			log.Printf("tunnel %s: %v, reconnecting", t.Local, err)
+			t.listener.Close()
+			for !t.isClosed() {
+				time.Sleep(time.Second)
+				if err := t.listen(); err == nil {
+					break
+				}
+			}
+			continue
+		}
+		wg.Add(1)
+		go t.relay(server, conn, wg)
+	}
+}
+
+func (t *Tunnel) relay(server Server, conn net.Conn, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer conn.Close()
+
+	cmd := transportCommand(server, t.user, fmt.Sprintf("nc %s %d", t.RemoteHost, t.RemotePort))
+	cmd.Stdin = conn
+	cmd.Stdout = conn
+	t.mutex.Lock()
+	if t.closed {
+		t.mutex.Unlock()
+		return
+	}
+	err := cmd.Start()
+	if err == nil {
+		t.active[conn] = cmd
+	}
+	t.mutex.Unlock()
+	if err == nil {
+		err = cmd.Wait()
+		t.mutex.Lock()
+		delete(t.active, conn)
+		t.mutex.Unlock()
+	}
+	if err != nil && !t.isClosed() {
+		log.Printf("tunnel %s -> %s:%d dropped: %v", t.Local, server.Name, t.RemotePort, err)
+	}
+}
+
+func printTunnels(tunnels []*Tunnel) {
+	for _, tunnel := range tunnels {
+		fmt.Printf("%s <-> %s:%s:%d\n", tunnel.Local, tunnel.Server, tunnel.RemoteHost, tunnel.RemotePort)
+	}
+}
+
+func writeTunnelsJSON(tunnels []*Tunnel, file string) error {
+	tunnelsJSON, err := json.MarshalIndent(tunnels, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, tunnelsJSON, 0644)
+}
+
+func tunnelCommand() cli.Command {
+	return cli.Command{
+		Name:      "tunnel",
+		Usage:     "Forward local ports to a port on each server",
+		ArgsUsage: " ",
+		Flags: []cli.Flag{
+			cli.IntFlag{
+				Name:  "remote, r",
+				Usage: "Remote `PORT` to forward to",
+			},
+			cli.StringFlag{
+				Name:  "remote-host",
+				Value: "127.0.0.1",
+				Usage: "Host to connect to, as seen from the server",
+			},
+			cli.IntFlag{
+				Name:  "local-port, p",
+				Usage: "First local `PORT`, incremented per server (default: random ports)",
+			},
+			cli.StringFlag{
+				Name:  "bind",
+				Value: "127.0.0.1",
+				Usage: "Local address to listen on",
+			},
+			cli.StringFlag{
+				Name:  "user, u",
+				Usage: "User to run as",
+			},
+			cli.StringFlag{
+				Name:  "json",
+				Usage: "Write the port map as JSON to `FILE`",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			remote := c.Int("remote")
+			if remote == 0 {
+				log.Fatalf("Error: remote flag is required for tunnel")
+			}
+			servers := selectedServers(c)
+			if len(servers) == 0 {
+				log.Fatalf("Error: no servers selected")
+			}
+
+			var tunnels []*Tunnel
+			for index, server := range servers {
+				port := 0
+				if c.Int("local-port") != 0 {
+					port = c.Int("local-port") + index
+				}
+				tunnel := &Tunnel{
+					Server:     server.Name,
+					Local:      net.JoinHostPort(c.String("bind"), strconv.Itoa(port)),
+					RemoteHost: c.String("remote-host"),
+					RemotePort: remote,
+					user:       defaultUser(c.GlobalString("settings"), server.Environment, c.String("user")),
+					active:     map[net.Conn]*exec.Cmd{},
+				}
+				if err := tunnel.listen(); err != nil {
+					log.Fatalf("Error: %v", err)
+				}
+				tunnels = append(tunnels, tunnel)
+			}
+
+			if c.String("json") != "" {
+				if err := writeTunnelsJSON(tunnels, c.String("json")); err != nil {
+					log.Fatalf("Error: %v", err)
+				}
+			}
+			printTunnels(tunnels)
+
+			var wg sync.WaitGroup
+			for index, tunnel := range tunnels {
+				wg.Add(1)
+				go tunnel.serve(servers[index], &wg)
+			}
+
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+			<-signals
+			for _, tunnel := range tunnels {
+				tunnel.close()
+			}
+			wg.Wait()
+			return nil
+		},
+	}
+}
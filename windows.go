@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// Window is a weekly recurring period in which changes are allowed, e.g.
+// Tue and Thu from 02:00 to 05:00 Europe/Berlin. An end before the start
+// means the window runs past midnight.
+type Window struct {
+	Days     []string `json:"days"`
+	Start    string   `json:"start"`
+	End      string   `json:"end"`
+	Timezone string   `json:"timezone,omitempty"`
+}
+
+// Freeze forbids changes between two instants, regardless of windows.
+type Freeze struct {
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func parseWeekday(day string) (time.Weekday, error) {
+	day = strings.ToLower(day)
+	if len(day) >= 3 {
+		if weekday, ok := weekdays[day[:3]]; ok {
+			return weekday, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown day %q", day)
+}
+
+func parseClock(clock string) (time.Duration, error) {
+	parsed, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", clock)
+	}
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+func (w Window) location() (*time.Location, error) {
+	if w.Timezone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(w.Timezone)
+}
+
+func (w Window) validate() error {
+	if len(w.Days) == 0 {
+		return errors.New("window has no days")
+	}
+	for _, day := range w.Days {
+		if _, err := parseWeekday(day); err != nil {
+			return err
+		}
+	}
+	if _, err := parseClock(w.Start); err != nil {
+		return err
+	}
+	if _, err := parseClock(w.End); err != nil {
+		return err
+	}
+	_, err := w.location()
+	return err
+}
+
+func (w Window) String() string {
+	location := w.Timezone
+	if location == "" {
+		location = "local time"
+	}
+	return fmt.Sprintf("%s %s-%s %s", strings.Join(w.Days, "/"), w.Start, w.End, location)
+}
+
+// occurrences returns the periods of the window that start on the given
+// number of days around t, in chronological order. The bounds are wall clock
+// times, so a window keeps its hours on the days the clocks change.
+func (w Window) occurrences(t time.Time, daysBefore int, daysAfter int) [][2]time.Time {
+	location, _ := w.location()
+	start, _ := parseClock(w.Start)
+	end, _ := parseClock(w.End)
+	endDay := 0
+	if end <= start {
+		endDay = 1
+	}
+	local := t.In(location)
+	at := func(offset int, clock time.Duration) time.Time {
+		return time.Date(local.Year(), local.Month(), local.Day()+offset, int(clock/time.Hour), int(clock%time.Hour/time.Minute), 0, 0, location)
+	}
+	var periods [][2]time.Time
+	for offset := -daysBefore; offset <= daysAfter; offset++ {
+		day := time.Date(local.Year(), local.Month(), local.Day()+offset, 12, 0, 0, 0, location)
+		for _, name := range w.Days {
+			weekday, _ := parseWeekday(name)
+			if day.Weekday() == weekday {
+				periods = append(periods, [2]time.Time{at(offset, start), at(offset+endDay, end)})
+				break
+			}
+		}
+	}
+	return periods
+}
+
+func (e Environment) freezeAt(t time.Time) (Freeze, bool) {
+	for _, freeze := range e.Freezes {
+		if !t.Before(freeze.Start) && t.Before(freeze.End) {
+			return freeze, true
+		}
+	}
+	return Freeze{}, false
+}
+
+// currentWindow reports whether changes are allowed at t and, if a window is
+// open, when it closes.
+func (e Environment) currentWindow(t time.Time) (open bool, closes time.Time) {
+	if _, frozen := e.freezeAt(t); frozen {
+		return false, time.Time{}
+	}
+	if len(e.Windows) == 0 {
+		return true, time.Time{}
+	}
+	for _, window := range e.Windows {
+		for _, period := range window.occurrences(t, 1, 0) {
+			if !t.Before(period[0]) && t.Before(period[1]) {
+				return true, period[1]
+			}
+		}
+	}
+	return false, time.Time{}
+}
+
+// nextWindow returns the next window opening after t that does not fall
+// into a freeze.
+func (e Environment) nextWindow(t time.Time) (start time.Time, end time.Time, found bool) {
+	var periods [][2]time.Time
+	for _, window := range e.Windows {
+		periods = append(periods, window.occurrences(t, 0, 366)...)
+	}
+	sort.Slice(periods, func(i, j int) bool { return periods[i][0].Before(periods[j][0]) })
+	for _, period := range periods {
+		if !period[0].After(t) {
+			continue
+		}
+		if _, frozen := e.freezeAt(period[0]); frozen {
+			continue
+		}
+		return period[0], period[1], true
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+func describeWindow(name string, environment Environment, t time.Time) string {
+	if freeze, frozen := environment.freezeAt(t); frozen {
+		description := fmt.Sprintf("%s frozen until %s", name, freeze.End.Format(time.RFC1123))
+		if freeze.Reason != "" {
+			description += " (" + freeze.Reason + ")"
+		}
+		return description
+	}
+	if len(environment.Windows) == 0 {
+		return name + " unrestricted"
+	}
+	if open, closes := environment.currentWindow(t); open {
+		return fmt.Sprintf("%s open until %s", name, closes.Format(time.RFC1123))
+	}
+	start, end, found := environment.nextWindow(t)
+	if !found {
+		return name + " closed, no upcoming window"
+	}
+	return fmt.Sprintf("%s closed, next window %s - %s", name, start.Format(time.RFC1123), end.Format(time.RFC1123))
+}
+
+// checkWindow refuses a run in a closed environment unless it is an
+// emergency, in which case the reason is written to the emergency log.
+func checkWindow(settings Settings, environment string, command string, emergency bool, reason string) error {
+	if emergency && strings.TrimSpace(reason) == "" {
+		return errors.New("--emergency requires --reason")
+	}
+	now := time.Now()
+	if open, _ := settings.Environments[environment].currentWindow(now); open {
+		return nil
+	}
+	if !emergency {
+		return fmt.Errorf("%s; use --emergency --reason to override", describeWindow(environment, settings.Environments[environment], now))
+	}
+	return logEmergency(environment, command, reason)
+}
+
+func logEmergency(environment string, command string, reason string) error {
+	file := dcrPath("emergency.log")
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	logFile, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	_, err = fmt.Fprintf(logFile, "%s %s %s %q %q\n", time.Now().Format(time.RFC3339), currentOwner(), environment, command, reason)
+	return err
+}
+
+func windowFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.BoolFlag{
+			Name:  "emergency",
+			Usage: "Run outside the environment's maintenance window",
+		},
+		cli.StringFlag{
+			Name:  "reason",
+			Usage: "Why an emergency run is needed, written to the emergency log",
+		},
+	}
+}
+
+func windowsCommand() cli.Command {
+	return cli.Command{
+		Name:  "windows",
+		Usage: "Show the current and next maintenance window of each environment",
+		Action: func(c *cli.Context) error {
+			settings, err := getSettings(c.GlobalString("settings"))
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			var names []string
+			for name := range settings.Environments {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			now := time.Now()
+			for _, name := range names {
+				fmt.Println(describeWindow(name, settings.Environments[name], now))
+				for _, window := range settings.Environments[name].Windows {
+					fmt.Printf("  %s\n", window)
+				}
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func mustTime(t *testing.T, value string) time.Time {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func berlinWindow(days string, start string, end string) Window {
+	return Window{Days: []string{days}, Start: start, End: end, Timezone: "Europe/Berlin"}
+}
+
+// The clocks in Berlin go forward on 2026-03-29 and back on 2026-10-25.
+func TestWindowOccurrences(t *testing.T) {
+	tests := []struct {
+		name   string
+		window Window
+		at     string
+		start  string
+		end    string
+	}{
+		{"normal day", berlinWindow("Sun", "01:00", "05:00"), "2026-03-22T12:00:00Z", "2026-03-22T00:00:00Z", "2026-03-22T04:00:00Z"},
+		{"spring forward", berlinWindow("Sun", "01:00", "05:00"), "2026-03-29T12:00:00Z", "2026-03-29T00:00:00Z", "2026-03-29T03:00:00Z"},
+		{"fall back", berlinWindow("Sun", "01:00", "05:00"), "2026-10-25T12:00:00Z", "2026-10-24T23:00:00Z", "2026-10-25T04:00:00Z"},
+		{"past midnight", berlinWindow("Sat", "22:00", "03:00"), "2026-10-24T12:00:00Z", "2026-10-24T20:00:00Z", "2026-10-25T02:00:00Z"},
+		{"utc", Window{Days: []string{"Tue"}, Start: "22:00", End: "02:00", Timezone: "UTC"}, "2026-03-24T12:00:00Z", "2026-03-24T22:00:00Z", "2026-03-25T02:00:00Z"},
+	}
+	for _, test := range tests {
+		periods := test.window.occurrences(mustTime(t, test.at), 0, 0)
+		if len(periods) != 1 {
+			t.Errorf("%s: got %d periods, want 1", test.name, len(periods))
+			continue
+		}
+		if !periods[0][0].Equal(mustTime(t, test.start)) || !periods[0][1].Equal(mustTime(t, test.end)) {
+			t.Errorf("%s: got %s - %s, want %s - %s", test.name, periods[0][0].UTC().Format(time.RFC3339), periods[0][1].UTC().Format(time.RFC3339), test.start, test.end)
+		}
+	}
+}
+
+func TestCurrentWindow(t *testing.T) {
+	tests := []struct {
+		name   string
+		window Window
+		at     string
+		open   bool
+		closes string
+	}{
+		{"fall back, after the extra hour", berlinWindow("Sun", "02:00", "05:00"), "2026-10-25T03:30:00Z", true, "2026-10-25T04:00:00Z"},
+		{"spring forward, after the end", berlinWindow("Sun", "02:00", "05:00"), "2026-03-29T03:30:00Z", false, ""},
+		{"spring forward, before the end", berlinWindow("Sun", "02:00", "05:00"), "2026-03-29T02:30:00Z", true, "2026-03-29T03:00:00Z"},
+		{"past midnight, next day", berlinWindow("Sat", "22:00", "03:00"), "2026-10-25T01:30:00Z", true, "2026-10-25T02:00:00Z"},
+		{"past midnight, after the end", berlinWindow("Sat", "22:00", "03:00"), "2026-10-25T02:30:00Z", false, ""},
+	}
+	for _, test := range tests {
+		environment := Environment{Windows: []Window{test.window}}
+		open, closes := environment.currentWindow(mustTime(t, test.at))
+		if open != test.open {
+			t.Errorf("%s: open = %v, want %v", test.name, open, test.open)
+			continue
+		}
+		if test.open && !closes.Equal(mustTime(t, test.closes)) {
+			t.Errorf("%s: closes %s, want %s", test.name, closes.UTC().Format(time.RFC3339), test.closes)
+		}
+	}
+}
+
+func TestNextWindow(t *testing.T) {
+	freeze := Freeze{Start: mustTime(t, "2026-10-24T00:00:00Z"), End: mustTime(t, "2026-10-26T00:00:00Z")}
+	tests := []struct {
+		name        string
+		environment Environment
+		at          string
+		start       string
+		end         string
+	}{
+		{"spring forward", Environment{Windows: []Window{berlinWindow("Sun", "01:00", "05:00")}}, "2026-03-28T12:00:00Z", "2026-03-29T00:00:00Z", "2026-03-29T03:00:00Z"},
+		{"fall back", Environment{Windows: []Window{berlinWindow("Sun", "01:00", "05:00")}}, "2026-10-24T12:00:00Z", "2026-10-24T23:00:00Z", "2026-10-25T04:00:00Z"},
+		{"past midnight", Environment{Windows: []Window{berlinWindow("Sat", "22:00", "03:00")}}, "2026-10-24T12:00:00Z", "2026-10-24T20:00:00Z", "2026-10-25T02:00:00Z"},
+		{"frozen", Environment{Windows: []Window{berlinWindow("Sun", "01:00", "05:00")}, Freezes: []Freeze{freeze}}, "2026-10-24T12:00:00Z", "2026-11-01T00:00:00Z", "2026-11-01T04:00:00Z"},
+	}
+	for _, test := range tests {
+		start, end, found := test.environment.nextWindow(mustTime(t, test.at))
+		if !found {
+			t.Errorf("%s: no next window", test.name)
+			continue
+		}
+		if !start.Equal(mustTime(t, test.start)) || !end.Equal(mustTime(t, test.end)) {
+			t.Errorf("%s: got %s - %s, want %s - %s", test.name, start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339), test.start, test.end)
+		}
+	}
+}